@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+const CACHE_META_FILE = "goip-cache.json"
+
+// ErrNotCached is returned when the cache has no database of the source.
+var ErrNotCached = errors.New("no cached database")
+
+// CacheEntry is an unpacked database version in the cache.
+type CacheEntry struct {
+	Dir          string    `json:"-"`
+	Source       string    `json:"source"`
+	Release      string    `json:"release"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	CheckedAt    time.Time `json:"checked_at"`
+}
+
+// BuildDate returns the build date in the release name, or the time it
+// was fetched.
+func (e CacheEntry) BuildDate() time.Time {
+	if t := geoip.ReleaseBuildDate(e.Release); !t.IsZero() {
+		return t
+	}
+	return e.FetchedAt
+}
+
+// DatabaseCache keeps the unpacked databases in Dir, so they can be
+// reused across runs.  Source identifies what was downloaded (e.g. the
+// editions); each source has its own subdirectory, with a directory per
+// version named after the release (e.g. GeoLite2-City-CSV_20171205).
+type DatabaseCache struct {
+	Dir string
+
+	// Number of versions kept per source; 0 keeps all of them.
+	Keep int
+}
+
+// DefaultCacheDir returns $XDG_CACHE_HOME/goip, or its equivalent on the
+// platform.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "goip-cache")
+	}
+	return filepath.Join(dir, "goip")
+}
+
+func readCacheEntry(dir string) (CacheEntry, error) {
+	var e CacheEntry
+	b, err := os.ReadFile(filepath.Join(dir, CACHE_META_FILE))
+	if err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal(b, &e); err != nil {
+		return e, fmt.Errorf("%v: %v", dir, err)
+	}
+	e.Dir = dir
+	return e, nil
+}
+
+func writeCacheEntry(e CacheEntry) error {
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(e.Dir, CACHE_META_FILE+".tmp")
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(e.Dir, CACHE_META_FILE))
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._,+-]+`)
+
+// sourceDir returns the subdirectory of the versions of source.
+func (c *DatabaseCache) sourceDir(source string) string {
+	name := strings.Trim(unsafeNameChars.ReplaceAllString(source, "_"), "._")
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	if name == "" {
+		name = "default"
+	}
+	return filepath.Join(c.Dir, name)
+}
+
+// Entries returns the cached versions of source, newest first.
+func (c *DatabaseCache) Entries(source string) ([]CacheEntry, error) {
+	base := c.sourceDir(source)
+	dirs, err := os.ReadDir(base)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]CacheEntry, 0)
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		e, err := readCacheEntry(filepath.Join(base, d.Name()))
+		if err != nil {
+			log.Printf("ignoring cache entry: %v", err)
+			continue
+		}
+		if e.Source == source {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		bi, bj := entries[i].BuildDate(), entries[j].BuildDate()
+		if !bi.Equal(bj) {
+			return bi.After(bj)
+		}
+		return entries[i].FetchedAt.After(entries[j].FetchedAt)
+	})
+	return entries, nil
+}
+
+// Latest returns the newest cached version of source, or ErrNotCached.
+func (c *DatabaseCache) Latest(source string) (CacheEntry, error) {
+	entries, err := c.Entries(source)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	if len(entries) == 0 {
+		return CacheEntry{}, ErrNotCached
+	}
+	return entries[0], nil
+}
+
+// versionName returns the directory name of a downloaded version.
+func versionName(release string, fetched time.Time) string {
+	if release == "" || strings.HasPrefix(release, ".") || strings.ContainsAny(release, `/\`) {
+		return "download_" + fetched.Format("20060102T150405")
+	}
+	return release
+}
+
+// Store moves the database unpacked by d into the cache, and removes the
+// old versions of source beyond c.Keep.
+func (c *DatabaseCache) Store(d *Downloader, source string) (CacheEntry, error) {
+	now := time.Now()
+	e := CacheEntry{
+		Dir:          filepath.Join(c.sourceDir(source), versionName(d.Release, now)),
+		Source:       source,
+		Release:      d.Release,
+		ETag:         d.ETag,
+		LastModified: d.LastModified,
+		FetchedAt:    now,
+		CheckedAt:    now,
+	}
+	meta := e
+	meta.Dir = d.Base
+	if err := writeCacheEntry(meta); err != nil {
+		return e, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(e.Dir), 0755); err != nil {
+		return e, err
+	}
+	// the same release downloaded again replaces the cached one
+	if err := os.RemoveAll(e.Dir); err != nil {
+		return e, err
+	}
+	if err := os.Rename(d.Base, e.Dir); err != nil {
+		return e, err
+	}
+	d.Base = ""
+	log.Printf("cached database: %v", e.Dir)
+
+	if err := c.Prune(source); err != nil {
+		log.Printf("cannot prune the cache: %v", err)
+	}
+	return e, nil
+}
+
+// Touch records that e was found up to date now.
+func (c *DatabaseCache) Touch(e *CacheEntry) error {
+	e.CheckedAt = time.Now()
+	return writeCacheEntry(*e)
+}
+
+// Prune removes the versions of source beyond c.Keep.
+func (c *DatabaseCache) Prune(source string) error {
+	if c.Keep <= 0 {
+		return nil
+	}
+	entries, err := c.Entries(source)
+	if err != nil {
+		return err
+	}
+	for i := c.Keep; i < len(entries); i++ {
+		log.Printf("removing old cached database: %v", entries[i].Dir)
+		if err := os.RemoveAll(entries[i].Dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the newest cached version of source if it was checked
+// within maxAge.  Otherwise the urls are downloaded with d, conditionally
+// on the cached version; if they did not change, the cached version is
+// returned with ErrNotModified.  If the download fails, the cached
+// version, if any, is returned instead with a warning.
+func (c *DatabaseCache) Get(d *Downloader, urls []string, source string, maxAge time.Duration) (CacheEntry, error) {
+	latest, err := c.Latest(source)
+	cached := err == nil
+	if err != nil && err != ErrNotCached {
+		return latest, err
+	}
+	if cached && maxAge > 0 && time.Since(latest.CheckedAt) < maxAge {
+		log.Printf("using cached database: %v", latest.Dir)
+		return latest, nil
+	}
+
+	base := c.sourceDir(source)
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return latest, err
+	}
+	if cached {
+		d.ETag, d.LastModified = latest.ETag, latest.LastModified
+	}
+	if d.Base == "" {
+		// unpack in the cache, so the version can be renamed into place
+		if d.Base, err = os.MkdirTemp(base, ".download"); err != nil {
+			return latest, err
+		}
+	}
+	if err := d.Download(urls); err != nil {
+		os.RemoveAll(d.Base)
+		d.Base = ""
+		if err == ErrNotModified && cached {
+			log.Printf("cached database is up to date: %v", latest.Dir)
+			if err := c.Touch(&latest); err != nil {
+				log.Printf("cannot update the cache entry: %v", err)
+			}
+			return latest, ErrNotModified
+		}
+		if cached {
+			log.Printf("Warning: cannot download the database, using the cached one: %v: %v", latest.Dir, err)
+			return latest, nil
+		}
+		return latest, err
+	}
+	return c.Store(d, source)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func storeTestRelease(t *testing.T, c *DatabaseCache, release string) CacheEntry {
+	d := Downloader{Base: filepath.Join(t.TempDir(), "unpacked"), Release: release}
+	os.Mkdir(d.Base, 0755)
+	os.WriteFile(filepath.Join(d.Base, GEOLITE_BLOCK_CSV_FILE), []byte("network,geoname_id\n"), 0644)
+	e, err := c.Store(&d, "GeoLite2-City-CSV")
+	if err != nil {
+		t.Fatalf("cannot store %v: %v", release, err)
+	}
+	return e
+}
+
+func TestDatabaseCache_Retention(t *testing.T) {
+	c := &DatabaseCache{Dir: t.TempDir(), Keep: 2}
+	for _, r := range []string{"GeoLite2-City-CSV_20180102", "GeoLite2-City-CSV_20180109", "GeoLite2-City-CSV_20180105"} {
+		storeTestRelease(t, c, r)
+	}
+
+	entries, err := c.Entries("GeoLite2-City-CSV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Release != "GeoLite2-City-CSV_20180109" || entries[1].Release != "GeoLite2-City-CSV_20180105" {
+		t.Errorf("unexpected cached versions: %+v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(entries[0].Dir, GEOLITE_BLOCK_CSV_FILE)); err != nil {
+		t.Errorf("database not in the cache: %v", err)
+	}
+	if _, err := c.Latest("GeoLite2-ASN"); err != ErrNotCached {
+		t.Errorf("expected ErrNotCached for another source, got %v", err)
+	}
+}
+
+func TestDatabaseCache_Fresh(t *testing.T) {
+	c := &DatabaseCache{Dir: t.TempDir()}
+	stored := storeTestRelease(t, c, "GeoLite2-City-CSV_20180102")
+
+	// a fresh version is used without any request
+	d := Downloader{}
+	e, err := c.Get(&d, []string{"http://127.0.0.1:1/unreachable"}, "GeoLite2-City-CSV", time.Hour)
+	if err != nil || e.Dir != stored.Dir {
+		t.Errorf("fresh cached version not used: %v, %v", e.Dir, err)
+	}
+
+	// a stale one is checked, and still used if the check fails
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "unavailable", http.StatusNotFound)
+	}))
+	defer server.Close()
+	e, err = c.Get(&d, []string{server.URL + "/GeoLite2-City-CSV.zip"}, "GeoLite2-City-CSV", 0)
+	if err != nil || e.Dir != stored.Dir || requests == 0 {
+		t.Errorf("stale cached version: %v, %v after %v requests", e.Dir, err, requests)
+	}
+
+	// without a cached version, the failure is returned
+	empty := &DatabaseCache{Dir: t.TempDir()}
+	if _, err := empty.Get(&Downloader{}, []string{server.URL + "/GeoLite2-City-CSV.zip"}, "GeoLite2-City-CSV", 0); err == nil {
+		t.Errorf("no error for a failed download")
+	}
+}
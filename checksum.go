@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// ChecksumMismatchError is returned by Fetch when the downloaded archive
+// does not have the expected SHA-256 digest.
+type ChecksumMismatchError struct {
+	URL      string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("SHA-256 mismatch of %v: expected %v, got %v", e.URL, e.Expected, e.Actual)
+}
+
+// ParseSHA256 parses a hex encoded SHA-256 digest, as given by -sha256 or
+// as the first field of a sha256sum(1) output line.
+func ParseSHA256(s string) (string, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || !sha256Pattern.MatchString(fields[0]) {
+		return "", fmt.Errorf("invalid SHA-256 digest: %q", s)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// checksumURL returns the url of the .sha256 file published next to the
+// archive.  For MaxMind permalinks, the format is selected by the suffix
+// parameter, e.g. suffix=zip.sha256.
+func checksumURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s + ".sha256"
+	}
+	q := u.Query()
+	if suffix := q.Get("suffix"); suffix != "" {
+		q.Set("suffix", suffix+".sha256")
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	u.Path += ".sha256"
+	return u.String()
+}
+
+// fetchChecksum downloads the .sha256 file of the archive at url, and
+// returns the digest in it.
+func (d *Downloader) fetchChecksum(archiveURL string) (string, error) {
+	s := checksumURL(archiveURL)
+	log.Printf("fetching checksum: %v", redactURL(s))
+	var b []byte
+	err := d.retry("download of "+redactURL(s), func() error {
+		resp, err := d.get(context.Background(), s, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := statusError(resp); err != nil {
+			return retryable(resp, err)
+		}
+		b, err = io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err != nil {
+			return &retryableError{err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot fetch the checksum: %v", err)
+	}
+	return ParseSHA256(string(b))
+}
+
+// verify compares the digest of the fetched archive to d.Checksum, or to
+// the published .sha256 file if d.VerifyChecksum is set.
+func (d *Downloader) verify(archiveURL string, digest []byte) error {
+	expected := d.Checksum
+	if expected == "" && d.VerifyChecksum {
+		var err error
+		if expected, err = d.fetchChecksum(archiveURL); err != nil {
+			return err
+		}
+	}
+	if expected == "" {
+		return nil
+	}
+	actual := hex.EncodeToString(digest)
+	if actual != strings.ToLower(expected) {
+		return &ChecksumMismatchError{URL: redactURL(archiveURL), Expected: expected, Actual: actual}
+	}
+	log.Printf("SHA-256 verified: %v", actual)
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"sort"
+	"strconv"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+// Mean radius of the earth, for the distances between the locations.
+const EARTH_RADIUS_KM = 6371.0088
+
+// Kinds of the disagreement between the two databases.
+const (
+	DIFF_NONE    = ""
+	DIFF_COUNTRY = "country"
+	DIFF_CITY    = "city"
+	DIFF_ONLY_A  = "only_a" // found only in the first database
+	DIFF_ONLY_B  = "only_b" // found only in the second database
+)
+
+// AddressComparison is the location of an address in the two databases.
+type AddressComparison struct {
+	Address  string
+	Count    int // number of input lines of the address
+	A        geoip.Location
+	B        geoip.Location
+	FoundA   bool
+	FoundB   bool
+	Diff     string
+	Distance float64 // in km, if found in both
+}
+
+// Comparison looks up the input addresses in two databases, e.g. two
+// releases or two vendors, and collects where they disagree.
+type Comparison struct {
+	A geoip.Database
+	B geoip.Database
+
+	Lines     int // lines with an address
+	Invalid   int // lines with an invalid address
+	addresses map[netip.Addr]*AddressComparison
+}
+
+func NewComparison(a, b geoip.Database) *Comparison {
+	return &Comparison{A: a, B: b, addresses: map[netip.Addr]*AddressComparison{}}
+}
+
+// Add looks up addr in both databases, once per distinct address.  It
+// returns nil if addr is not an IP address.
+func (c *Comparison) Add(addr string) *AddressComparison {
+	c.Lines++
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		c.Invalid++
+		return nil
+	}
+	if r, ok := c.addresses[ip]; ok {
+		r.Count++
+		return r
+	}
+	r := &AddressComparison{Address: ip.String(), Count: 1}
+	var errA, errB error
+	r.A, errA = c.A.Lookup(ip)
+	r.B, errB = c.B.Lookup(ip)
+	r.FoundA, r.FoundB = errA == nil, errB == nil
+	switch {
+	case r.FoundA && !r.FoundB:
+		r.Diff = DIFF_ONLY_A
+	case !r.FoundA && r.FoundB:
+		r.Diff = DIFF_ONLY_B
+	case !r.FoundA:
+	case r.A.Country != r.B.Country:
+		r.Diff = DIFF_COUNTRY
+	case r.A.City != r.B.City:
+		r.Diff = DIFF_CITY
+	}
+	if r.FoundA && r.FoundB {
+		r.Distance = Distance(r.A.Latitude, r.A.Longitude, r.B.Latitude, r.B.Longitude)
+	}
+	c.addresses[ip] = r
+	return r
+}
+
+// FeedInput compares the address of every non-empty line of reader.
+func (c *Comparison) FeedInput(name string, reader io.Reader) InputSummary {
+	summary := InputSummary{Name: name}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		addr, _ := ParseLine(scanner.Text())
+		if addr == "" {
+			continue
+		}
+		summary.Lines++
+		if r := c.Add(addr); r != nil && r.FoundA && r.FoundB {
+			summary.Matches++
+		}
+	}
+	summary.Error = scanner.Err()
+	return summary
+}
+
+// FeedFile opens the named input and compares its addresses.
+func (c *Comparison) FeedFile(filename string) InputSummary {
+	f, err := OpenInput(filename)
+	if err != nil {
+		return InputSummary{Name: filename, Error: err}
+	}
+	summary := c.FeedInput(filename, f)
+	if err := f.Close(); err != nil && summary.Error == nil {
+		summary.Error = err
+	}
+	return summary
+}
+
+// Distance returns the great-circle distance in km between two
+// coordinates in degrees.
+func Distance(lat1, lon1, lat2, lon2 float32) float64 {
+	rad := func(d float32) float64 { return float64(d) * math.Pi / 180 }
+	dlat := rad(lat2 - lat1)
+	dlon := rad(lon2 - lon1)
+	h := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * EARTH_RADIUS_KM * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Results returns the compared addresses, the most frequent first.
+func (c *Comparison) Results() []*AddressComparison {
+	results := make([]*AddressComparison, 0, len(c.addresses))
+	for _, r := range c.addresses {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Count != results[j].Count {
+			return results[i].Count > results[j].Count
+		}
+		return results[i].Address < results[j].Address
+	})
+	return results
+}
+
+// WriteAddresses writes the addresses where the databases disagree, or
+// all addresses if all is set, in csv.
+func (c *Comparison) WriteAddresses(out io.Writer, all bool) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"address", "count", "diff", "country_a", "city_a", "country_b", "city_b", "distance_km"})
+	for _, r := range c.Results() {
+		if r.Diff == DIFF_NONE && !all {
+			continue
+		}
+		distance := ""
+		if r.FoundA && r.FoundB {
+			distance = strconv.FormatFloat(r.Distance, 'f', 1, 64)
+		}
+		w.Write([]string{r.Address, strconv.Itoa(r.Count), r.Diff,
+			r.A.Country, r.A.City, r.B.Country, r.B.City, distance})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// ComparisonSummary aggregates the disagreement, over the input lines.
+type ComparisonSummary struct {
+	Lines     int
+	Invalid   int
+	Addresses int // distinct addresses
+	Compared  int // lines found in both databases
+	OnlyA     int
+	OnlyB     int
+	Neither   int
+	Country   int // lines of a different country
+	City      int // lines of the same country and a different city
+
+	MeanDistance   float64
+	MedianDistance float64
+	P90Distance    float64
+	MaxDistance    float64
+}
+
+// Summary aggregates the comparison of the lines added so far.
+func (c *Comparison) Summary() ComparisonSummary {
+	s := ComparisonSummary{Lines: c.Lines, Invalid: c.Invalid, Addresses: len(c.addresses)}
+	type weighted struct {
+		distance float64
+		count    int
+	}
+	distances := []weighted{}
+	total := 0.0
+	for _, r := range c.addresses {
+		switch {
+		case r.FoundA && r.FoundB:
+			s.Compared += r.Count
+			distances = append(distances, weighted{r.Distance, r.Count})
+			total += r.Distance * float64(r.Count)
+		case r.FoundA:
+			s.OnlyA += r.Count
+		case r.FoundB:
+			s.OnlyB += r.Count
+		default:
+			s.Neither += r.Count
+		}
+		switch r.Diff {
+		case DIFF_COUNTRY:
+			s.Country += r.Count
+		case DIFF_CITY:
+			s.City += r.Count
+		}
+	}
+	if s.Compared == 0 {
+		return s
+	}
+	sort.Slice(distances, func(i, j int) bool { return distances[i].distance < distances[j].distance })
+	percentile := func(p float64) float64 {
+		rank := int(math.Ceil(p * float64(s.Compared)))
+		n := 0
+		for _, d := range distances {
+			if n += d.count; n >= rank {
+				return d.distance
+			}
+		}
+		return distances[len(distances)-1].distance
+	}
+	s.MeanDistance = total / float64(s.Compared)
+	s.MedianDistance = percentile(0.5)
+	s.P90Distance = percentile(0.9)
+	s.MaxDistance = distances[len(distances)-1].distance
+	return s
+}
+
+// WriteComparisonSummary writes the summary as comment lines, like
+// WriteInputSummary.
+func WriteComparisonSummary(out io.Writer, a, b geoip.Info, s ComparisonSummary) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	percent := func(n int) string {
+		if s.Compared == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.2f%%", float64(n)*100/float64(s.Compared))
+	}
+	fmt.Fprintf(w, "# A: %v\n", a)
+	fmt.Fprintf(w, "# B: %v\n", b)
+	fmt.Fprintf(w, "# %-24s %10d\n", "lines", s.Lines)
+	fmt.Fprintf(w, "# %-24s %10d\n", "invalid", s.Invalid)
+	fmt.Fprintf(w, "# %-24s %10d\n", "distinct addresses", s.Addresses)
+	fmt.Fprintf(w, "# %-24s %10d\n", "found in both", s.Compared)
+	fmt.Fprintf(w, "# %-24s %10d\n", "found only in A", s.OnlyA)
+	fmt.Fprintf(w, "# %-24s %10d\n", "found only in B", s.OnlyB)
+	fmt.Fprintf(w, "# %-24s %10d\n", "found in neither", s.Neither)
+	fmt.Fprintf(w, "# %-24s %10d %8s\n", "different country", s.Country, percent(s.Country))
+	fmt.Fprintf(w, "# %-24s %10d %8s\n", "different city", s.City, percent(s.City))
+	fmt.Fprintf(w, "# %-24s %10.1f\n", "mean distance (km)", s.MeanDistance)
+	fmt.Fprintf(w, "# %-24s %10.1f\n", "median distance (km)", s.MedianDistance)
+	fmt.Fprintf(w, "# %-24s %10.1f\n", "90th pct. distance (km)", s.P90Distance)
+	fmt.Fprintf(w, "# %-24s %10.1f\n", "max distance (km)", s.MaxDistance)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+func newTestRangeDatabase(entries ...geoip.RangeEntry) *geoip.RangeDatabase {
+	return &geoip.RangeDatabase{Backend: "test", Entries: entries}
+}
+
+func TestDistance(t *testing.T) {
+	// Tokyo to Fairfield, NJ
+	if d := Distance(35.685, 139.7514, 40.8838, -74.306); math.Abs(d-10820) > 10 {
+		t.Errorf("unexpected distance: %v", d)
+	}
+	if d := Distance(1, 2, 1, 2); d != 0 {
+		t.Errorf("unexpected distance: %v", d)
+	}
+}
+
+func TestComparison(t *testing.T) {
+	a := newTestRangeDatabase(
+		geoip.RangeEntry{IP4Range: geoip.IP4Range{Begin: 0x03030300, End: 0x030303ff}, Country: "US", City: "Fairfield", Latitude: 40.8838, Longitude: -74.306},
+		geoip.RangeEntry{IP4Range: geoip.IP4Range{Begin: 0x6f6f0000, End: 0x6f6fffff}, Country: "JP", City: "Tokyo", Latitude: 35.685, Longitude: 139.7514},
+		geoip.RangeEntry{IP4Range: geoip.IP4Range{Begin: 0x70000000, End: 0x700000ff}, Country: "KR", City: "Seoul", Latitude: 37.5665, Longitude: 126.978},
+	)
+	b := newTestRangeDatabase(
+		geoip.RangeEntry{IP4Range: geoip.IP4Range{Begin: 0x03030300, End: 0x030303ff}, Country: "US", City: "Newark", Latitude: 40.7357, Longitude: -74.1724},
+		geoip.RangeEntry{IP4Range: geoip.IP4Range{Begin: 0x6f6f0000, End: 0x6f6fffff}, Country: "JP", City: "Tokyo", Latitude: 35.685, Longitude: 139.7514},
+		geoip.RangeEntry{IP4Range: geoip.IP4Range{Begin: 0x70000000, End: 0x700000ff}, Country: "JP", City: "Tokyo", Latitude: 35.685, Longitude: 139.7514},
+		geoip.RangeEntry{IP4Range: geoip.IP4Range{Begin: 0x80000000, End: 0x800000ff}, Country: "DE", City: "Berlin", Latitude: 52.5244, Longitude: 13.4105},
+	)
+	c := NewComparison(a, b)
+	input := "3.3.3.3\n111.111.1.1\n111.111.1.1\n112.0.0.1\n128.0.0.1\nbogus\n"
+	summary := c.FeedInput("test", strings.NewReader(input))
+	if summary.Lines != 6 || summary.Matches != 4 {
+		t.Errorf("unexpected input summary: %+v", summary)
+	}
+
+	s := c.Summary()
+	if s.Lines != 6 || s.Invalid != 1 || s.Addresses != 4 || s.Compared != 4 || s.OnlyB != 1 ||
+		s.Country != 1 || s.City != 1 {
+		t.Errorf("unexpected summary: %+v", s)
+	}
+	if s.MedianDistance != 0 || s.MaxDistance < 1000 || s.MeanDistance <= 0 {
+		t.Errorf("unexpected distances: %+v", s)
+	}
+
+	var out bytes.Buffer
+	if err := c.WriteAddresses(&out, false); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "112.0.0.1,1,country,KR,Seoul,JP,Tokyo,") ||
+		!strings.HasPrefix(lines[3], "3.3.3.3,1,city,US,Fairfield,US,Newark,") {
+		t.Errorf("unexpected addresses:\n%v", out.String())
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+var diffFormats = []string{"csv", "json"}
+
+// CheckDiffFormat returns an error if format is not one of diffFormats.
+func CheckDiffFormat(format string) error {
+	for _, f := range diffFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown diff format %q (one of %v)", format, diffFormats)
+}
+
+// WriteDiff writes the ranges that changed from oldDB to newDB.  In csv,
+// a line is written per range to out, and the summary as comment lines to
+// summaryOut; in json, a single document with both is written to out.
+func WriteDiff(out io.Writer, summaryOut io.Writer, format string, oldDB, newDB geoip.Database) error {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	if format == "json" {
+		doc := struct {
+			geoip.DiffSummary
+			Ranges []geoip.DiffEntry `json:"ranges"`
+		}{Ranges: []geoip.DiffEntry{}}
+		var err error
+		doc.DiffSummary, err = geoip.Diff(oldDB, newDB, func(e geoip.DiffEntry) {
+			doc.Ranges = append(doc.Ranges, e)
+		})
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(doc)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"kind", "first", "last", "addresses",
+		"old_network", "old_country", "old_city", "new_network", "new_country", "new_city"})
+	summary, err := geoip.Diff(oldDB, newDB, func(e geoip.DiffEntry) {
+		record := []string{e.Kind, e.First.String(), e.Last.String(), strconv.FormatUint(e.Addresses, 10)}
+		for _, loc := range []*geoip.Location{e.Old, e.New} {
+			if loc == nil {
+				record = append(record, "", "", "")
+				continue
+			}
+			record = append(record, locationRange(*loc), loc.Country, loc.City)
+		}
+		cw.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	WriteDiffSummary(summaryOut, summary)
+	return nil
+}
+
+// locationRange returns the block of loc as a CIDR, or as a range if it
+// is not a CIDR block.
+func locationRange(loc geoip.Location) string {
+	if loc.Network.IsValid() {
+		return loc.Network.String()
+	}
+	return loc.First.String() + "-" + loc.Last.String()
+}
+
+// WriteDiffSummary writes the summary as comment lines, like
+// WriteInputSummary.
+func WriteDiffSummary(out io.Writer, s geoip.DiffSummary) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	country := func(c string) string {
+		if c == "" {
+			return "UNKNOWN"
+		}
+		return c
+	}
+	fmt.Fprintf(w, "# old: %v\n", s.Old)
+	fmt.Fprintf(w, "# new: %v\n", s.New)
+	fmt.Fprintf(w, "# %-24s %10s %14s\n", "change", "ranges", "addresses")
+	for _, c := range []struct {
+		name  string
+		count geoip.DiffCount
+	}{
+		{"added", s.Added},
+		{"removed", s.Removed},
+		{"country reassigned", s.Country},
+		{"city reassigned", s.City},
+	} {
+		fmt.Fprintf(w, "# %-24s %10d %14d\n", c.name, c.count.Ranges, c.count.Addresses)
+	}
+	for _, m := range s.Moves {
+		fmt.Fprintf(w, "# moved %-18s %25d\n", country(m.From)+" -> "+country(m.To), m.Addresses)
+	}
+}
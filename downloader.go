@@ -1,24 +1,74 @@
 package main
 
 import (
-	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"path"
+	"strings"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
 )
 
 const GEOLITE_ARCHIVE_URL = "http://geolite.maxmind.com/download/geoip/database/GeoLite2-City-CSV.zip"
-const GEOLITE_BLOCK_CSV_FILE = "GeoLite2-City-Blocks-IPv4.csv"
-const GEOLITE_CITY_CSV_FILE = "GeoLite2-City-Locations-en.csv"
+const GEOLITE_BLOCK_CSV_FILE = geoip.BLOCK_CSV_FILE
+const GEOLITE_CITY_CSV_FILE = geoip.CITY_CSV_FILE
+
+// ErrNotModified is returned by Fetch when the archive did not change
+// since the ETag or LastModified of the Downloader.
+var ErrNotModified = errors.New("not modified")
 
 type Downloader struct {
 	URL     string
 	Archive string
 	Base    string
+	Release string // top directory in the archive, e.g. GeoLite2-City-CSV_20171205
+
+	// If set before Fetch, the archive is downloaded only if it changed.
+	// Fetch updates them from the response.
+	ETag         string
+	LastModified string
+
+	// HTTP basic authentication, e.g. MaxMind account ID and license key
+	Username string
+	Password string
+
+	// Expected SHA-256 digest (hex) of the next fetched archive.  If it
+	// is empty and VerifyChecksum is set, the digest is fetched from the
+	// .sha256 file next to the archive.
+	Checksum       string
+	VerifyChecksum bool
+
+	// Directory of the downloaded archives and the unpacked files; the
+	// default temporary directory if empty.
+	WorkDir string
+
+	// Size limits of the unpacked files (see Extractor)
+	MaxFileSize  int64
+	MaxTotalSize int64
+
+	// HTTP client; http.DefaultClient if nil (see NewHTTPClient).
+	Client *http.Client
+	// Number of retries of a failed transfer, and the delay before the
+	// first one (MIN_RETRY_DELAY if 0), doubled for each next one.
+	Retries    int
+	RetryDelay time.Duration
+	// A transfer receiving no data for StallTimeout is retried; 0 waits
+	// forever.
+	StallTimeout time.Duration
+	// If set, the progress of the transfers is reported to it.
+	Progress io.Writer
+
+	archives  []string
+	extracted int64
 }
 
 func (d *Downloader) Close() {
@@ -26,73 +76,299 @@ func (d *Downloader) Close() {
 		log.Printf("removing %v", d.Base)
 		os.RemoveAll(d.Base)
 	}
-	if d.Archive != "" {
-		log.Printf("removing %v", d.Archive)
-		os.Remove(d.Archive)
+	for _, archive := range d.archives {
+		log.Printf("removing %v", archive)
+		os.Remove(archive)
 	}
 }
 
+// Unpack extracts the database files of the last fetched archive, either
+// zip or tar.gz, into d.Base.  d.Base is created in d.WorkDir if it is not
+// set yet, so several archives can be unpacked into the same directory.
 func (d *Downloader) Unpack() error {
-	dir, err := ioutil.TempDir("/tmp", "geoip")
-	if err != nil {
-		return err
+	if d.Base == "" {
+		dir, err := os.MkdirTemp(d.WorkDir, "geoip")
+		if err != nil {
+			return err
+		}
+		d.Base = dir
 	}
-	d.Base = dir
 
-	r, err := zip.OpenReader(d.Archive)
-	defer r.Close()
-	if err != nil {
-		return err
+	e := Extractor{Dir: d.Base, MaxFileSize: d.MaxFileSize, MaxTotalSize: d.MaxTotalSize, total: d.extracted}
+	err := e.Extract(d.Archive)
+	d.extracted = e.total
+	if d.Release == "" {
+		d.Release = e.Release
 	}
-	for _, f := range r.File {
-		basename := path.Base(f.Name)
-		log.Printf("decompressing: %v\n", basename)
-		outname := path.Join(d.Base, path.Base(f.Name))
+	return err
+}
 
-		src, err := f.Open()
-		if err != nil {
+// Download fetches every url, and unpacks them into d.Base.  The
+// conditional headers and d.Checksum apply to the first url only; if it
+// did not change, ErrNotModified is returned without fetching the others.
+func (d *Downloader) Download(urls []string) error {
+	var etag, lastModified string
+	for i, url := range urls {
+		if i > 0 {
+			d.ETag, d.LastModified = "", ""
+			d.Checksum = ""
+		}
+		if err := d.Fetch(url); err != nil {
 			return err
 		}
-		defer src.Close()
+		if i == 0 {
+			etag, lastModified = d.ETag, d.LastModified
+		}
+		if err := d.Unpack(); err != nil {
+			return fmt.Errorf("cannot unpack %v: %v", redactURL(url), err)
+		}
+	}
+	d.ETag, d.LastModified = etag, lastModified
+	return nil
+}
+
+// get sends a GET request to url with the credentials and the given
+// header.
+func (d *Downloader) get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if d.Username != "" || d.Password != "" {
+		req.SetBasicAuth(d.Username, d.Password)
+	}
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ue, ok := err.(*neturl.Error); ok {
+			ue.URL = redactURL(ue.URL)
+		}
+		return nil, &retryableError{err: err}
+	}
+	log.Printf("status: %v", resp.Status)
+	return resp, nil
+}
 
-		dst, err := os.Create(outname)
-		if err != nil {
+// retry calls f until it succeeds, or fails with an error that is not
+// worth retrying, up to d.Retries times more.
+func (d *Downloader) retry(what string, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if _, ok := err.(*retryableError); !ok || attempt >= d.Retries {
 			return err
 		}
-		defer dst.Close()
-		io.Copy(dst, src)
+		delay := backoff(attempt, err, d.RetryDelay)
+		log.Printf("%v failed, retrying in %v: %v", what, delay, err)
+		if d.Progress != nil {
+			fmt.Fprintf(d.Progress, "%v failed, retrying in %v: %v\n", what, delay.Round(time.Second), err)
+		}
+		time.Sleep(delay)
 	}
-	return nil
 }
 
+// statusError explains a non 200 response.
+func statusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return fmt.Errorf("authentication failed (%v): check the MaxMind account ID and license key", resp.Status)
+	case http.StatusForbidden:
+		return fmt.Errorf("access denied (%v): the account may not be allowed to download this edition", resp.Status)
+	case http.StatusTooManyRequests:
+		msg := fmt.Sprintf("too many downloads (%v): MaxMind limits the daily downloads, try again later", resp.Status)
+		if after := resp.Header.Get("Retry-After"); after != "" {
+			msg += fmt.Sprintf(" (retry after %v)", after)
+		}
+		return errors.New(msg)
+	case http.StatusNotFound:
+		return fmt.Errorf("not found (%v): check the url or the edition ID", resp.Status)
+	default:
+		return fmt.Errorf("non 200 status: %v", resp.Status)
+	}
+}
+
+// Fetch downloads the archive at url.  If d.Checksum or d.VerifyChecksum
+// is set, the archive is kept only if its SHA-256 digest matches.
+//
+// The archive is written to a partial file first; if the transfer fails,
+// it is retried up to d.Retries times, resuming from the end of the
+// partial file with a Range request when the server supports it.
 func (d *Downloader) Fetch(url string) error {
-	log.Printf("fetching url: %v", url)
-	resp, err := http.Get(url)
+	log.Printf("fetching url: %v", redactURL(url))
+	out, err := os.CreateTemp(d.WorkDir, "geoarchive*.partial")
+	if err != nil {
+		return err
+	}
+	partial := out.Name()
+	out.Close()
+	log.Printf("saving to %v", partial)
+
+	t := transfer{url: url, partial: partial}
+	err = d.retry("download of "+redactURL(url), func() error { return d.fetchPartial(&t) })
+	if err == nil {
+		err = d.verifyFile(url, partial)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+
+	archive := strings.TrimSuffix(partial, ".partial")
+	if err := os.Rename(partial, archive); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	d.URL = url
+	d.Archive = archive
+	d.archives = append(d.archives, d.Archive)
+	d.ETag = t.etag
+	d.LastModified = t.lastModified
+	return nil
+}
+
+// transfer is the state of a download across the attempts.
+type transfer struct {
+	url          string
+	partial      string
+	etag         string
+	lastModified string
+	started      bool // a response was received, i.e. etag and lastModified are set
+}
+
+// fetchPartial makes an attempt of the transfer t, appending to the
+// partial file if a previous attempt received a part of it.
+func (d *Downloader) fetchPartial(t *transfer) error {
+	fi, err := os.Stat(t.partial)
+	if err != nil {
+		return err
+	}
+	offset := fi.Size()
+
+	header := http.Header{}
+	if !t.started {
+		if d.ETag != "" {
+			header.Set("If-None-Match", d.ETag)
+		}
+		if d.LastModified != "" {
+			header.Set("If-Modified-Since", d.LastModified)
+		}
+	} else if offset > 0 && (t.etag != "" || t.lastModified != "") {
+		// resume only if the archive is still the same
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if t.etag != "" {
+			header.Set("If-Range", t.etag)
+		} else {
+			header.Set("If-Range", t.lastModified)
+		}
+	} else {
+		offset = 0
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp, err := d.get(ctx, t.url, header)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	log.Printf("status: %v", resp.Status)
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("non 200 status: %v", resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusNotModified && !t.started:
+		return ErrNotModified
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			os.Truncate(t.partial, 0)
+			return &retryableError{err: fmt.Errorf("unexpected Content-Range: %q", resp.Header.Get("Content-Range"))}
+		}
+		log.Printf("resuming at %v", offset)
+	case resp.StatusCode == http.StatusOK:
+		offset = 0
+	default:
+		err := statusError(resp)
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			os.Truncate(t.partial, 0)
+			return &retryableError{err: err}
+		}
+		return retryable(resp, err)
+	}
+	if !t.started {
+		t.etag = resp.Header.Get("ETag")
+		t.lastModified = resp.Header.Get("Last-Modified")
+		t.started = true
 	}
 
-	out, err := ioutil.TempFile("/tmp", "geoarchive")
+	flags := os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flags = os.O_WRONLY | os.O_TRUNC
+	}
+	out, err := os.OpenFile(t.partial, flags, 0600)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
-	log.Printf("saving to %v", out.Name())
-	_, err = io.Copy(out, resp.Body)
+
+	var w io.Writer = out
+	var progress *Progress
+	if d.Progress != nil {
+		total := int64(-1)
+		if resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+		progress = NewProgress(d.Progress, archiveName(resp), offset, total)
+		w = io.MultiWriter(out, progress)
+	}
+	var body io.Reader = resp.Body
+	if d.StallTimeout > 0 {
+		stall := newStallReader(resp.Body, d.StallTimeout, cancel)
+		defer stall.Stop()
+		body = stall
+	}
+	n, err := io.Copy(w, body)
+	if progress != nil {
+		progress.Finish()
+	}
+	if err == nil && resp.ContentLength >= 0 && n < resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		// the partial file is kept, to be resumed
+		return &retryableError{err: fmt.Errorf("transfer interrupted after %v bytes: %v", offset+n, err)}
+	}
+	return out.Close()
+}
+
+// verifyFile verifies the SHA-256 digest of the downloaded file.
+func (d *Downloader) verifyFile(url string, name string) error {
+	if d.Checksum == "" && !d.VerifyChecksum {
+		return nil
+	}
+	f, err := os.Open(name)
 	if err != nil {
-		os.Remove(out.Name())
 		return err
 	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	return d.verify(url, hash.Sum(nil))
+}
 
-	d.URL = url
-	d.Archive = out.Name()
-	return nil
+// archiveName returns the file name of the downloaded archive, for the
+// progress report.
+func archiveName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+	return path.Base(resp.Request.URL.Path)
 }
 
 func smain() {
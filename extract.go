@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Default limits of the extracted sizes, against decompression bombs.  The
+// largest GeoLite2 file (City blocks of IPv6) is about 200MB unpacked.
+const MAX_EXTRACT_FILE_SIZE = 1 << 30
+const MAX_EXTRACT_TOTAL_SIZE = 4 << 30
+
+// Extractor unpacks the database files of an archive into Dir.  The
+// archive members are flattened: only their base names are used.
+type Extractor struct {
+	Dir string
+
+	// Maximum size of a file, and of all extracted files; 0 means the
+	// MAX_EXTRACT_FILE_SIZE and MAX_EXTRACT_TOTAL_SIZE.
+	MaxFileSize  int64
+	MaxTotalSize int64
+
+	// Release is the top directory of the first member, e.g.
+	// GeoLite2-City-CSV_20171205.
+	Release string
+
+	total int64
+}
+
+// wantedMember reports whether the archive member is a file goip needs,
+// i.e. a CSV or an MMDB database.
+func wantedMember(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".csv" || ext == ".mmdb"
+}
+
+// checkMemberName rejects the member names that may escape the directory
+// or overwrite something else, such as absolute paths and "..".
+func checkMemberName(name string) error {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return fmt.Errorf("invalid member name %q", name)
+	}
+	if strings.Contains(name, `\`) || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("unsafe member name %q", name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return fmt.Errorf("unsafe member name %q", name)
+		}
+	}
+	return nil
+}
+
+func (e *Extractor) maxFileSize() int64 {
+	if e.MaxFileSize > 0 {
+		return e.MaxFileSize
+	}
+	return MAX_EXTRACT_FILE_SIZE
+}
+
+func (e *Extractor) maxTotalSize() int64 {
+	if e.MaxTotalSize > 0 {
+		return e.MaxTotalSize
+	}
+	return MAX_EXTRACT_TOTAL_SIZE
+}
+
+func (e *Extractor) setRelease(name string) {
+	if e.Release == "" && strings.Contains(name, "/") {
+		e.Release = name[:strings.Index(name, "/")]
+	}
+}
+
+// Extract unpacks archive, either zip or tar.gz, depending on its magic.
+func (e *Extractor) Extract(archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	magic := make([]byte, 2)
+	_, err = io.ReadFull(f, magic)
+	f.Close()
+	if err == nil && string(magic) == string(gzipMagic) {
+		return e.ExtractTarGz(archive)
+	}
+	return e.ExtractZip(archive)
+}
+
+// ExtractZip unpacks a zip archive.  archive/zip verifies the CRC-32 of
+// each file when it is read to the end, so a corrupted archive fails here.
+func (e *Extractor) ExtractZip(archive string) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if err := checkMemberName(f.Name); err != nil {
+			return err
+		}
+		e.setRelease(f.Name)
+		if !f.Mode().IsRegular() || !wantedMember(f.Name) {
+			continue
+		}
+		if err := e.extractZipFile(f); err != nil {
+			return fmt.Errorf("%v: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func (e *Extractor) extractZipFile(f *zip.File) error {
+	if f.UncompressedSize64 > uint64(e.maxFileSize()) {
+		return fmt.Errorf("file too large (%v bytes)", f.UncompressedSize64)
+	}
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return e.write(path.Base(f.Name), src)
+}
+
+// ExtractTarGz unpacks a gzip compressed tar archive.
+func (e *Extractor) ExtractTarGz(archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	r := tar.NewReader(gz)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			// read up to the gzip trailer, to verify its CRC-32
+			_, err = io.Copy(io.Discard, gz)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkMemberName(hdr.Name); err != nil {
+			return err
+		}
+		e.setRelease(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !wantedMember(hdr.Name) {
+			continue
+		}
+		if hdr.Size > e.maxFileSize() {
+			return fmt.Errorf("%v: file too large (%v bytes)", hdr.Name, hdr.Size)
+		}
+		if err := e.write(path.Base(hdr.Name), r); err != nil {
+			return fmt.Errorf("%v: %v", hdr.Name, err)
+		}
+	}
+}
+
+// write copies src into the file name in e.Dir, enforcing the size limits
+// whatever the archive header claims.  An existing file is not replaced.
+func (e *Extractor) write(name string, src io.Reader) error {
+	log.Printf("decompressing: %v", name)
+	limit := e.maxFileSize()
+	if remain := e.maxTotalSize() - e.total; remain < limit {
+		limit = remain
+	}
+
+	outname := filepath.Join(e.Dir, name)
+	dst, err := os.OpenFile(outname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, io.LimitReader(src, limit+1))
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > limit {
+		err = fmt.Errorf("extracted size exceeds the limit (%v bytes)", limit)
+	}
+	if err != nil {
+		os.Remove(outname)
+		return err
+	}
+	e.total += n
+	return nil
+}
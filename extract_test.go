@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeArchive(t *testing.T, archive []byte) string {
+	name := path.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(name, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestExtractor_UnsafeNames(t *testing.T) {
+	for _, name := range []string{"../evil.csv", "GeoLite2/../../evil.csv", "/etc/evil.csv", "GeoLite2/..", `..\evil.csv`} {
+		for _, archive := range [][]byte{
+			zipArchive(map[string]string{name: "x"}),
+			tarGzArchive(map[string]string{name: "x"}),
+		} {
+			e := Extractor{Dir: t.TempDir()}
+			if err := e.Extract(writeArchive(t, archive)); err == nil || !strings.Contains(err.Error(), "member name") {
+				t.Errorf("%q: expected unsafe member name, got %v", name, err)
+			}
+		}
+	}
+}
+
+func TestExtractor_WantedFiles(t *testing.T) {
+	files := map[string]string{
+		"GeoLite2-City-CSV_20180102/" + GEOLITE_BLOCK_CSV_FILE: "network,geoname_id\n",
+		"GeoLite2-City-CSV_20180102/LICENSE.txt":               "license",
+		"GeoLite2-City-CSV_20180102/GeoLite2-City.mmdb":        "mmdb",
+	}
+	for _, archive := range [][]byte{zipArchive(files), tarGzArchive(files)} {
+		e := Extractor{Dir: t.TempDir()}
+		if err := e.Extract(writeArchive(t, archive)); err != nil {
+			t.Fatalf("extract failed: %v", err)
+		}
+		entries, _ := os.ReadDir(e.Dir)
+		if len(entries) != 2 {
+			t.Errorf("expected the CSV and the MMDB files only, got %v", entries)
+		}
+		if e.Release != "GeoLite2-City-CSV_20180102" {
+			t.Errorf("unexpected release: %v", e.Release)
+		}
+	}
+}
+
+func TestExtractor_SizeLimits(t *testing.T) {
+	files := map[string]string{
+		"GeoLite2/a.csv": strings.Repeat("a", 1000),
+		"GeoLite2/b.csv": strings.Repeat("b", 1000),
+	}
+	for _, archive := range [][]byte{zipArchive(files), tarGzArchive(files)} {
+		e := Extractor{Dir: t.TempDir(), MaxFileSize: 999}
+		if err := e.Extract(writeArchive(t, archive)); err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Errorf("file size limit not enforced: %v", err)
+		}
+
+		e = Extractor{Dir: t.TempDir(), MaxTotalSize: 1500}
+		if err := e.Extract(writeArchive(t, archive)); err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+			t.Errorf("total size limit not enforced: %v", err)
+		}
+	}
+}
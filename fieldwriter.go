@@ -140,6 +140,6 @@ func NewFormatter(formatType string, fieldOrder string, fieldSeparator string) (
 	case "csv":
 		return NewCSVFormatter(forder), nil
 	default:
-		return nil, fmt.Errorf("unknown formatter type: %v", formatterName)
+		return nil, fmt.Errorf("unknown formatter type: %v", formatType)
 	}
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const FOLLOW_POLL_INTERVAL = time.Second
+
+// Follower reads the lines appended to a file, like tail -F.  It keeps
+// following the file name across rotation (the name now refers to a
+// different file), and starts over when the file is truncated.
+type Follower struct {
+	Filename string
+
+	file   *os.File
+	reader *bufio.Reader
+	offset int64
+}
+
+func NewFollower(filename string) *Follower {
+	return &Follower{Filename: filename}
+}
+
+func (f *Follower) open(seekEnd bool) error {
+	file, err := os.Open(f.Filename)
+	if err != nil {
+		return err
+	}
+	f.offset = 0
+	if seekEnd {
+		f.offset, err = file.Seek(0, io.SeekEnd)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	f.file = file
+	f.reader = bufio.NewReader(file)
+	return nil
+}
+
+func (f *Follower) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+}
+
+// rotated reports whether the file name refers to another file than the
+// one being read.  A missing file name is not a rotation yet; the new
+// file may not be created.
+func (f *Follower) rotated() bool {
+	cur, err := os.Stat(f.Filename)
+	if err != nil {
+		return false
+	}
+	old, err := f.file.Stat()
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(cur, old)
+}
+
+func (f *Follower) truncated() bool {
+	info, err := f.file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Size() < f.offset
+}
+
+func sleepOrQuit(d time.Duration, quit <-chan struct{}) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+// Follow sends every line appended to the file to lines, until quit is
+// closed.  Following starts at the end of the file.  If the file does not
+// exist yet, Follow waits for it, and reads it from the beginning.
+func (f *Follower) Follow(lines chan<- string, quit <-chan struct{}) {
+	defer f.close()
+
+	first := true
+	partial := ""
+	for {
+		if f.file == nil {
+			err := f.open(first)
+			first = false
+			if err != nil {
+				log.Printf("cannot open %v, retrying: %v", f.Filename, err)
+				if !sleepOrQuit(FOLLOW_POLL_INTERVAL, quit) {
+					return
+				}
+				continue
+			}
+			log.Printf("following %v from offset %v", f.Filename, f.offset)
+		}
+
+		line, err := f.reader.ReadString('\n')
+		f.offset += int64(len(line))
+		partial += line
+		if err == nil {
+			select {
+			case lines <- strings.TrimRight(partial, "\r\n"):
+			case <-quit:
+				return
+			}
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			Err(0, err, "reading %v", f.Filename)
+			f.close()
+			continue
+		}
+
+		if f.rotated() {
+			log.Printf("%v rotated", f.Filename)
+			if partial != "" {
+				select {
+				case lines <- strings.TrimRight(partial, "\r\n"):
+				case <-quit:
+					return
+				}
+				partial = ""
+			}
+			f.close()
+			continue
+		}
+		if f.truncated() {
+			log.Printf("%v truncated", f.Filename)
+			f.file.Seek(0, io.SeekStart)
+			f.reader.Reset(f.file)
+			f.offset = 0
+			partial = ""
+			continue
+		}
+
+		if !sleepOrQuit(FOLLOW_POLL_INTERVAL, quit) {
+			return
+		}
+	}
+}
+
+// Reporter writes statistics reports either to a stream, or to a file
+// which is replaced atomically on every report.
+type Reporter struct {
+	Server   *Server
+	Filename string
+	Stream   io.Writer
+	Template StatisticRequest
+
+	reports int
+}
+
+func (r *Reporter) Report() error {
+	req := r.Template
+	req.Done = make(chan struct{})
+	if req.Window > 0 {
+		req.Until = time.Now()
+	}
+
+	if r.Filename == "" {
+		if r.reports > 0 {
+			io.WriteString(r.Stream, "\n")
+		}
+		req.Stream = r.Stream
+		r.Server.Incoming <- req
+		<-req.Done
+		r.reports++
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.Filename), "."+filepath.Base(r.Filename))
+	if err != nil {
+		return err
+	}
+	req.Stream = tmp
+	r.Server.Incoming <- req
+	<-req.Done
+	r.reports++
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.Filename); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// FollowInputs follows every input file, feeds the new lines to the
+// server, and emits a report every interval, and every everyLines lines
+// if positive.  The standard input ("-") is read until EOF.
+func FollowInputs(server *Server, inputs []string, reporter *Reporter, interval time.Duration, everyLines int, quit <-chan struct{}) {
+	lines := make(chan string)
+
+	for _, name := range inputs {
+		if name == "-" {
+			go func() {
+				scanner := bufio.NewScanner(os.Stdin)
+				for scanner.Scan() {
+					select {
+					case lines <- scanner.Text():
+					case <-quit:
+						return
+					}
+				}
+			}()
+			continue
+		}
+		go NewFollower(name).Follow(lines, quit)
+	}
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	report := func() {
+		if err := reporter.Report(); err != nil {
+			Err(0, err, "cannot write the report")
+		}
+	}
+
+	count := 0
+	for {
+		select {
+		case line := <-lines:
+			addr, t := ParseLine(line)
+			if addr == "" {
+				continue
+			}
+			server.Lookup(addr, t)
+			count++
+			if everyLines > 0 && count%everyLines == 0 {
+				report()
+			}
+		case <-tick:
+			report()
+		case <-quit:
+			return
+		}
+	}
+}
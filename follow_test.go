@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+// expectLines waits for the expected lines from the follower, in order.
+func expectLines(t *testing.T, lines <-chan string, expected ...string) {
+	t.Helper()
+	for _, e := range expected {
+		select {
+		case line := <-lines:
+			if line != e {
+				t.Fatalf("expected line %q, got %q", e, line)
+			}
+		case <-time.After(5 * FOLLOW_POLL_INTERVAL):
+			t.Fatalf("timeout waiting for %q", e)
+		}
+	}
+}
+
+func appendFile(t *testing.T, filename string, data string) {
+	t.Helper()
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "access.log")
+	appendFile(t, filename, "old line\n")
+
+	lines := make(chan string)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		NewFollower(filename).Follow(lines, quit)
+		close(done)
+	}()
+	// the existing lines are skipped; wait for the follower to open the
+	// file before appending
+	time.Sleep(FOLLOW_POLL_INTERVAL / 2)
+
+	appendFile(t, filename, "1.0.0.1\n1.0.0.2\r\n")
+	expectLines(t, lines, "1.0.0.1", "1.0.0.2")
+
+	// rotation: the partial line of the old file is sent, and the new
+	// file is read from its beginning
+	appendFile(t, filename, "1.0.0.3")
+	if err := os.Rename(filename, filename+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, filename, "1.0.1.1 a longer line than the next one\n")
+	expectLines(t, lines, "1.0.0.3", "1.0.1.1 a longer line than the next one")
+
+	// truncation: the file is read again from its beginning
+	if err := os.Truncate(filename, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, filename, "1.0.2.1\n")
+	expectLines(t, lines, "1.0.2.1")
+
+	appendFile(t, filename+".1", "1.0.0.4\n")
+	appendFile(t, filename, "1.0.2.2\n")
+	expectLines(t, lines, "1.0.2.2")
+
+	close(quit)
+	select {
+	case <-done:
+	case <-time.After(5 * FOLLOW_POLL_INTERVAL):
+		t.Fatal("Follow did not return")
+	}
+}
+
+func TestFollower_Missing(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "access.log")
+
+	lines := make(chan string)
+	quit := make(chan struct{})
+	defer close(quit)
+	go NewFollower(filename).Follow(lines, quit)
+	time.Sleep(FOLLOW_POLL_INTERVAL / 2)
+
+	// a file created later is read from its beginning
+	appendFile(t, filename, "1.0.0.1\n")
+	expectLines(t, lines, "1.0.0.1")
+}
+
+var testReportRequest = StatisticRequest{Limit: -1, Formatter: NewCSVFormatter([]PopulationField{F_NAME, F_COUNT})}
+
+func TestReporter_File(t *testing.T) {
+	server := NewServer(geoip.NewHandle(newTestBlockDatabase(10, 2)))
+	server.Start()
+	defer server.Close()
+
+	dir := t.TempDir()
+	reporter := &Reporter{
+		Server:   server,
+		Filename: filepath.Join(dir, "report.csv"),
+		Template: testReportRequest,
+	}
+
+	server.Lookup("1.0.0.1", time.Time{})
+	if err := reporter.Report(); err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.Open(reporter.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+
+	server.Lookup("1.0.0.2", time.Time{})
+	if err := reporter.Report(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first report is replaced as a whole, not rewritten in place
+	var first bytes.Buffer
+	if _, err := first.ReadFrom(old); err != nil {
+		t.Fatal(err)
+	}
+	if s := first.String(); !strings.Contains(s, "\"ZZ: City0\",1") {
+		t.Errorf("unexpected first report:\n%v", s)
+	}
+	second, err := os.ReadFile(reporter.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(second); !strings.Contains(s, "\"ZZ: City0\",2") {
+		t.Errorf("unexpected second report:\n%v", s)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files left: %v", entries)
+	}
+}
+
+func TestReporter_Stream(t *testing.T) {
+	server := NewServer(geoip.NewHandle(newTestBlockDatabase(10, 2)))
+	server.Start()
+	defer server.Close()
+
+	var out bytes.Buffer
+	reporter := &Reporter{
+		Server:   server,
+		Stream:   &out,
+		Template: testReportRequest,
+	}
+	server.Lookup("1.0.0.1", time.Time{})
+	for i := 0; i < 2; i++ {
+		if err := reporter.Report(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reports := strings.Split(out.String(), "\n\n")
+	if len(reports) != 2 || reports[0]+"\n" != reports[1] || !strings.Contains(reports[0], "\"ZZ: City0\",1") {
+		t.Errorf("unexpected reports:\n%v", out.String())
+	}
+}
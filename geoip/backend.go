@@ -0,0 +1,63 @@
+package geoip
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Names of the backends of this package.
+const BACKEND_MAXMIND_CSV = "maxmind-csv"
+const BACKEND_DBIP_CSV = "dbip-csv"
+
+// OpenFunc loads the database of a backend at path, a directory or a file
+// depending on the backend.
+type OpenFunc func(path string, opts Options) (Database, error)
+
+var (
+	backendsLock sync.RWMutex
+	backends     = map[string]OpenFunc{}
+)
+
+func init() {
+	Register(BACKEND_MAXMIND_CSV, func(path string, opts Options) (Database, error) {
+		return Open(path, opts)
+	})
+	Register(BACKEND_DBIP_CSV, func(path string, opts Options) (Database, error) {
+		return OpenDBIP(path, opts)
+	})
+}
+
+// Register makes a backend available to OpenBackend under name.  It
+// panics if the name is already registered.
+func Register(name string, open OpenFunc) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	if _, ok := backends[name]; ok {
+		panic("geoip: backend registered twice: " + name)
+	}
+	backends[name] = open
+}
+
+// Backends returns the names of the registered backends, sorted.
+func Backends() []string {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenBackend loads the database at path with the backend of the name.
+func OpenBackend(name string, path string, opts Options) (Database, error) {
+	backendsLock.RLock()
+	open, ok := backends[name]
+	backendsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q (one of %v)", name, Backends())
+	}
+	return open(path, opts)
+}
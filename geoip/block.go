@@ -0,0 +1,461 @@
+package geoip
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BlockEntry struct {
+	IP4Range
+	GeoID     int
+	Latitude  float32
+	Longitude float32
+	City      CityEntry
+}
+
+type ByBegin []BlockEntry
+
+func (b ByBegin) Len() int {
+	return len(b)
+}
+func (b ByBegin) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+func (b ByBegin) Less(i, j int) bool {
+	return b[i].Begin < b[j].Begin
+}
+
+func (e BlockEntry) String() string {
+	return fmt.Sprintf("%s-%s: id=%v, location=(%f, %f), city=(%v)", Uint32ToIP(e.Begin), Uint32ToIP(e.End), e.GeoID, e.Longitude, e.Latitude, e.City)
+	// return fmt.Sprintf("%10d-%10d: id=%v, location=(%f, %f)",
+	// 	e.Begin, e.End, e.GeoID, e.Longitude, e.Latitude)
+}
+
+// BlockDatabase is a GeoLite2 City database.  The blocks are kept in
+// parallel arrays sorted by their first address, and refer to a table of
+// the distinct locations, whose country and city names are interned.  See
+// Info.Memory for the memory used.
+type BlockDatabase struct {
+	Source    string
+	BuildDate time.Time
+	LoadedAt  time.Time
+
+	begin     []uint32
+	end       []uint32
+	loc       []uint32 // index of locations
+	locations []blockLocation
+	names     []string // by the index in blockLocation; 0 is ""
+	cities    int
+
+	// bytes of the tables mapped from a snapshot, which are unmapped when
+	// the database is garbage collected; only Entry and rangeAt read the
+	// tables, and keep the database alive while reading them
+	mapped int64
+	index  *Trie
+}
+
+// blockLocation is a distinct location of the blocks.  Its layout is
+// also the layout in a snapshot (see Options.Snapshot).
+type blockLocation struct {
+	GeoID     int32
+	Latitude  float32
+	Longitude float32
+	Country   uint32 // index of names
+	City      uint32 // index of names
+}
+
+// blockBuilder appends the blocks to a database, and dedups their
+// locations and names.
+type blockBuilder struct {
+	db        *BlockDatabase
+	locations map[blockLocation]uint32
+	names     map[string]uint32
+}
+
+func newBlockBuilder(db *BlockDatabase) *blockBuilder {
+	b := &blockBuilder{db: db, locations: map[blockLocation]uint32{}, names: map[string]uint32{}}
+	b.name("")
+	return b
+}
+
+// name returns the index of s, interning a copy of s that does not keep
+// the line it was parsed from in memory.
+func (b *blockBuilder) name(s string) uint32 {
+	if i, ok := b.names[s]; ok {
+		return i
+	}
+	s = strings.Clone(s)
+	i := uint32(len(b.db.names))
+	b.db.names = append(b.db.names, s)
+	b.names[s] = i
+	return i
+}
+
+// location returns the index of the location.
+func (b *blockBuilder) location(geoID int, lat, lng float32, city CityEntry) uint32 {
+	l := blockLocation{
+		GeoID:     int32(geoID),
+		Latitude:  lat,
+		Longitude: lng,
+		Country:   b.name(city.Country),
+		City:      b.name(city.Name),
+	}
+	if i, ok := b.locations[l]; ok {
+		return i
+	}
+	i := uint32(len(b.db.locations))
+	b.db.locations = append(b.db.locations, l)
+	b.locations[l] = i
+	return i
+}
+
+func (b *blockBuilder) add(r IP4Range, loc uint32) {
+	b.db.begin = append(b.db.begin, r.Begin)
+	b.db.end = append(b.db.end, r.End)
+	b.db.loc = append(b.db.loc, loc)
+}
+
+// finish sorts the blocks, trims the tables and builds the index.  It
+// reports whether the blocks were already sorted.
+func (b *blockBuilder) finish() bool {
+	db := b.db
+	sorted := sort.IsSorted(blockOrder{db})
+	if !sorted {
+		sort.Sort(blockOrder{db})
+	}
+	db.begin = slices.Clip(slices.Clone(db.begin))
+	db.end = slices.Clip(slices.Clone(db.end))
+	db.loc = slices.Clip(slices.Clone(db.loc))
+	db.locations = slices.Clip(slices.Clone(db.locations))
+	db.names = slices.Clip(db.names)
+	db.BuildIndex()
+	return sorted
+}
+
+// blockOrder sorts the parallel arrays of the blocks by begin.
+type blockOrder struct{ db *BlockDatabase }
+
+func (o blockOrder) Len() int           { return len(o.db.begin) }
+func (o blockOrder) Less(i, j int) bool { return o.db.begin[i] < o.db.begin[j] }
+func (o blockOrder) Swap(i, j int) {
+	db := o.db
+	db.begin[i], db.begin[j] = db.begin[j], db.begin[i]
+	db.end[i], db.end[j] = db.end[j], db.end[i]
+	db.loc[i], db.loc[j] = db.loc[j], db.loc[i]
+}
+
+// NewBlockDatabase returns the database of the entries, in any order,
+// with its index built.  Its number of cities is the number of distinct
+// GeoIDs of the City of the entries.
+func NewBlockDatabase(entries []BlockEntry) *BlockDatabase {
+	db := &BlockDatabase{LoadedAt: time.Now()}
+	b := newBlockBuilder(db)
+	cities := map[int]bool{}
+	for _, e := range entries {
+		b.add(e.IP4Range, b.location(e.GeoID, e.Latitude, e.Longitude, e.City))
+		if e.City.GeoID != 0 {
+			cities[e.City.GeoID] = true
+		}
+	}
+	db.cities = len(cities)
+	b.finish()
+	return db
+}
+
+// blockKey is the GeoID and the coordinates of a block, which are joined
+// with the city once for all of their blocks.
+type blockKey struct {
+	geoID    int
+	lat, lng float32
+}
+
+type parsedBlock struct {
+	IP4Range
+	key blockKey
+}
+
+// blockChunk is the blocks parsed from a part of the block file.
+type blockChunk struct {
+	blocks  []parsedBlock
+	lines   int
+	ignored int
+	err     error
+}
+
+// The block file is split in chunks of at least MIN_CHUNK_SIZE bytes,
+// parsed in parallel.
+const MIN_CHUNK_SIZE = 1 << 20
+
+func newBlockDatabase(csvFilename string, cityDB *CityDatabase, workers int, logger *log.Logger) (*BlockDatabase, error) {
+	f, err := os.Open(csvFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := fi.Size()
+	n := int(min(int64(workers), size/MIN_CHUNK_SIZE+1))
+	chunks := make([]blockChunk, n)
+	var wg sync.WaitGroup
+	for i := range chunks {
+		wg.Add(1)
+		go func(c *blockChunk, begin, end int64) {
+			defer wg.Done()
+			c.parse(f, begin, end)
+		}(&chunks[i], size*int64(i)/int64(n), size*int64(i+1)/int64(n))
+	}
+	wg.Wait()
+
+	lines, ignored, total := 0, 0, 0
+	for i := range chunks {
+		if chunks[i].err != nil {
+			return nil, chunks[i].err
+		}
+		lines += chunks[i].lines
+		ignored += chunks[i].ignored
+		total += len(chunks[i].blocks)
+	}
+	logger.Printf("parsed %v lines in %v chunks, %v lines ignored", lines, n, ignored)
+
+	db := BlockDatabase{Source: csvFilename, cities: len(cityDB.Entries)}
+	b := newBlockBuilder(&db)
+	db.begin = make([]uint32, 0, total)
+	db.end = make([]uint32, 0, total)
+	db.loc = make([]uint32, 0, total)
+	joined := map[blockKey]uint32{}
+	unknown := 0
+	for i := range chunks {
+		for _, p := range chunks[i].blocks {
+			loc, ok := joined[p.key]
+			if !ok {
+				city, err := cityDB.Search(p.key.geoID)
+				if err != nil {
+					unknown++
+				}
+				loc = b.location(p.key.geoID, p.key.lat, p.key.lng, city)
+				joined[p.key] = loc
+			}
+			b.add(p.IP4Range, loc)
+		}
+		chunks[i].blocks = nil
+	}
+	if unknown > 0 {
+		logger.Printf("no city entry for %v geoIDs", unknown)
+	}
+
+	if b.finish() {
+		logger.Printf("blocks already sorted")
+	}
+	logger.Printf("%v blocks of %v locations and %v names, index of %v prefixes built",
+		len(db.begin), len(db.locations), len(db.names), db.index.Len())
+	return &db, nil
+}
+
+// parse parses the lines of f that start from begin to before end.  The
+// line at begin is a header if begin is 0.  No field of the block file has
+// a newline, so every line is a record.
+func (c *blockChunk) parse(f *os.File, begin, end int64) {
+	start := begin
+	if begin > 0 {
+		// the line that starts at or after begin
+		r := bufio.NewReader(io.NewSectionReader(f, begin-1, end-begin+1))
+		skipped, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		start = begin - 1 + int64(len(skipped))
+	}
+	if start >= end {
+		return
+	}
+	section := io.NewSectionReader(f, start, math.MaxInt64-start)
+	reader := csv.NewReader(bufio.NewReaderSize(section, 1<<16))
+	reader.ReuseRecord = true
+	if begin == 0 {
+		reader.Read() // ignore the header line
+	}
+	for start+reader.InputOffset() < end {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.lines++
+
+		r, err := NewIP4Range(record[0])
+		if err != nil {
+			// log.Printf("%d: cannot parse %v as CIDR, ignored: %v", lineno, record[0], err)
+			c.ignored++
+			continue
+		}
+
+		geoid, err := strconv.ParseUint(record[1], 10, 31)
+		if err != nil {
+			// log.Printf("%d: cannot parse %v as uint32, ignored: %v", lineno, record[1], err)
+			c.ignored++
+			continue
+		}
+
+		lat, err := strconv.ParseFloat(record[7], 32)
+		if err != nil {
+			// log.Printf("%d: cannot parse %v as float32, ignored: %v", lineno, record[7], err)
+			c.ignored++
+			continue
+		}
+
+		lng, err := strconv.ParseFloat(record[8], 32)
+		if err != nil {
+			// log.Printf("%d: cannot parse %v as float32, ignored: %v", lineno, record[8], err)
+			c.ignored++
+			continue
+		}
+
+		c.blocks = append(c.blocks, parsedBlock{r, blockKey{int(geoid), float32(lat), float32(lng)}})
+	}
+}
+
+// BuildIndex builds the trie of the blocks, which the lookups use instead
+// of a binary search.
+func (b *BlockDatabase) BuildIndex() {
+	index := NewTrie()
+	for i := range b.begin {
+		index.Insert(b.rangeAt(i).Prefix(), int32(i))
+	}
+	index.Compact()
+	b.index = index
+}
+
+// Len returns the number of blocks.
+func (b *BlockDatabase) Len() int {
+	return len(b.begin)
+}
+
+// Entry returns the i-th block in address order.
+func (b *BlockDatabase) Entry(i int) BlockEntry {
+	l := &b.locations[b.loc[i]]
+	e := BlockEntry{
+		IP4Range:  b.rangeAt(i),
+		GeoID:     int(l.GeoID),
+		Latitude:  l.Latitude,
+		Longitude: l.Longitude,
+	}
+	if l.Country != 0 || l.City != 0 {
+		e.City = CityEntry{GeoID: e.GeoID, Country: b.names[l.Country], Name: b.names[l.City]}
+	}
+	runtime.KeepAlive(b) // see BlockDatabase.mapped
+	return e
+}
+
+// Search returns the block containing the address in ip.
+func (b *BlockDatabase) Search(ip string) (BlockEntry, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return BlockEntry{}, &LookupError{Addr: ip, Err: ErrInvalidAddress}
+	}
+	return b.SearchAddr(addr)
+}
+
+// SearchAddr returns the block containing addr.
+func (b *BlockDatabase) SearchAddr(addr netip.Addr) (BlockEntry, error) {
+	target, err := addrToUint32(addr)
+	if err != nil {
+		return BlockEntry{}, err
+	}
+
+	idx := -1
+	if b.index != nil {
+		if i, ok := b.index.Lookup(addr); ok {
+			idx = int(i)
+		}
+	} else {
+		idx = searchSorted(b, target)
+	}
+	if idx < 0 {
+		return BlockEntry{}, &LookupError{Addr: addr.String(), Err: ErrNotFound}
+	}
+	return b.Entry(idx), nil
+}
+
+// searchSorted returns the index of the range of l containing target by a
+// binary search, or -1.  The ranges must be sorted, and must not overlap.
+func searchSorted(l rangeList, target uint32) int {
+	idx := sort.Search(l.numRanges(), func(i int) bool {
+		return target <= l.rangeAt(i).End
+	})
+	if idx == l.numRanges() || target < l.rangeAt(idx).Begin {
+		return -1
+	}
+	return idx
+}
+
+// Location returns the location of the block.
+func (e BlockEntry) Location() Location {
+	return Location{
+		First:     e.First(),
+		Last:      e.Last(),
+		Network:   e.IP4Range.Prefix(),
+		GeoID:     e.GeoID,
+		Country:   e.City.Country,
+		City:      e.City.Name,
+		Latitude:  e.Latitude,
+		Longitude: e.Longitude,
+	}
+}
+
+// Lookup returns the location of addr.
+func (b *BlockDatabase) Lookup(addr netip.Addr) (Location, error) {
+	e, err := b.SearchAddr(addr)
+	if err != nil {
+		return Location{}, err
+	}
+	return e.Location(), nil
+}
+
+// LookupIP returns the location of ip.
+func (b *BlockDatabase) LookupIP(ip net.IP) (Location, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return Location{}, &LookupError{Addr: ip.String(), Err: ErrInvalidAddress}
+	}
+	return b.Lookup(addr)
+}
+
+// LookupString returns the location of the address in s.
+func (b *BlockDatabase) LookupString(s string) (Location, error) {
+	e, err := b.Search(s)
+	if err != nil {
+		return Location{}, err
+	}
+	return e.Location(), nil
+}
+
+// Walk calls fn with the location of every block in address order, until
+// fn returns false.
+func (b *BlockDatabase) Walk(fn func(Location) bool) {
+	for i := range b.begin {
+		if !fn(b.Entry(i).Location()) {
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package geoip
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestRelease writes a release of n /24 blocks over ncity cities to
+// a new directory, with the blocks in address order unless shuffled.
+func writeTestRelease(tb testing.TB, n, ncity int, shuffled bool) string {
+	dir := filepath.Join(tb.TempDir(), "GeoLite2-City-CSV_20180102")
+	os.Mkdir(dir, 0755)
+	r := rand.New(rand.NewSource(1))
+
+	f, _ := os.Create(filepath.Join(dir, CITY_CSV_FILE))
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,subdivision_1_iso_code,subdivision_1_name,subdivision_2_iso_code,subdivision_2_name,city_name,metro_code,time_zone")
+	for i := 1; i <= ncity; i++ {
+		fmt.Fprintf(w, "%v,en,NA,\"North America\",Z%c,Zland,,,,,\"City %v\",,Etc/UTC\n", i, 'A'+i%26, i)
+	}
+	w.Flush()
+	f.Close()
+
+	order := r.Perm(n)
+	if !shuffled {
+		for i := range order {
+			order[i] = i
+		}
+	}
+	f, _ = os.Create(filepath.Join(dir, BLOCK_CSV_FILE))
+	w = bufio.NewWriter(f)
+	fmt.Fprintln(w, "network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,postal_code,latitude,longitude,accuracy_radius")
+	for _, i := range order {
+		city := i%ncity + 1
+		fmt.Fprintf(w, "%v/24,%v,%v,,0,0,,%.4f,%.4f,100\n",
+			Uint32ToIP(0x01000000+uint32(i)<<8), city, city, float32(city%180)-90, float32(city%360)-180)
+	}
+	w.Flush()
+	f.Close()
+	return dir
+}
+
+func TestOpen_Workers(t *testing.T) {
+	for _, shuffled := range []bool{false, true} {
+		dir := writeTestRelease(t, 100000, 1000, shuffled)
+		serial, err := Open(dir, Options{Workers: 1})
+		if err != nil {
+			t.Fatalf("cannot open the database: %v", err)
+		}
+		parallel, err := Open(dir, Options{Workers: 7})
+		if err != nil {
+			t.Fatalf("cannot open the database: %v", err)
+		}
+		if serial.Len() != 100000 || parallel.Len() != serial.Len() {
+			t.Fatalf("shuffled=%v: %v blocks, %v in parallel", shuffled, serial.Len(), parallel.Len())
+		}
+		for i := 0; i < serial.Len(); i++ {
+			e1, e2 := serial.Entry(i), parallel.Entry(i)
+			if e1 != e2 || e1.Begin != 0x01000000+uint32(i)<<8 || e1.City.GeoID != i%1000+1 {
+				t.Fatalf("shuffled=%v: block %v: %v, %v in parallel", shuffled, i, e1, e2)
+			}
+		}
+		if info := parallel.Info(); info.Cities != 1000 || info.Locations != 1000 {
+			t.Errorf("unexpected info: %v", info)
+		}
+	}
+}
+
+// The startup time and allocations of loading a release as large as
+// GeoLite2 City.
+func benchmarkOpen(b *testing.B, workers int) {
+	dir := writeTestRelease(b, 2700000, 100000, false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Open(dir, Options{Workers: workers}); err != nil {
+			b.Fatalf("cannot open the database: %v", err)
+		}
+	}
+}
+
+func BenchmarkOpen_Serial(b *testing.B) {
+	benchmarkOpen(b, 1)
+}
+
+func BenchmarkOpen_Parallel(b *testing.B) {
+	benchmarkOpen(b, 0)
+}
@@ -1,4 +1,4 @@
-package main
+package geoip
 
 import (
 	"encoding/csv"
@@ -35,16 +35,19 @@ func (e CityEntry) String() string {
 type CityDatabase struct {
 	Source  string
 	Entries []CityEntry
+
+	index map[int]int // index of Entries by GeoID
 }
 
-func NewCityDatabase(csvFilename string) (*CityDatabase, error) {
+func newCityDatabase(csvFilename string, logger *log.Logger) (*CityDatabase, error) {
 	f, err := os.Open(csvFilename)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 	reader := csv.NewReader(f)
 
-	db := CityDatabase{}
+	db := CityDatabase{Source: csvFilename}
 	db.Entries = make([]CityEntry, 0, 103546)
 	reader.Read() // ignore the header line
 	lineno := 1
@@ -73,19 +76,30 @@ func NewCityDatabase(csvFilename string) (*CityDatabase, error) {
 
 		db.Entries = append(db.Entries, entry)
 	}
-	log.Printf("parsed %v lines, %v lines ignored", lineno, ignored)
+	logger.Printf("parsed %v lines, %v lines ignored", lineno, ignored)
 
 	sort.Sort(ByGeoId(db.Entries))
-	log.Printf("sort finished")
+	logger.Printf("sort finished")
 
+	db.index = make(map[int]int, len(db.Entries))
+	for i, e := range db.Entries {
+		db.index[e.GeoID] = i
+	}
 	return &db, nil
 }
 
+// Search returns the city of the GeoID id.
 func (b *CityDatabase) Search(id int) (CityEntry, error) {
+	if b.index != nil {
+		if idx, ok := b.index[id]; ok {
+			return b.Entries[idx], nil
+		}
+		return CityEntry{}, fmt.Errorf("no entry matched to %v", id)
+	}
 	idx := sort.Search(len(b.Entries), func(i int) bool {
 		return id <= b.Entries[i].GeoID
 	})
-	if idx == len(b.Entries) {
+	if idx == len(b.Entries) || b.Entries[idx].GeoID != id {
 		return CityEntry{}, fmt.Errorf("no entry matched to %v", id)
 	}
 	return b.Entries[idx], nil
@@ -0,0 +1,357 @@
+// Package geoip looks up the geolocation of IP addresses in the MaxMind
+// GeoLite2 City database, in its CSV format.
+//
+//	db, err := geoip.Open("GeoLite2-City-CSV_20171205", geoip.Options{})
+//	if err != nil {
+//		...
+//	}
+//	loc, err := db.Lookup(netip.MustParseAddr("111.111.111.111"))
+//	fmt.Println(loc.Country, loc.City) // JP Tokyo
+//
+// The block and range databases hold IPv4 networks only, and return
+// ErrUnsupportedAddress for an IPv6 address other than IPv4-mapped.  The
+// overrides, the special-purpose classification and the Trie support IPv6
+// too.
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// File names of the block and the city databases in a GeoLite2 City CSV
+// release.
+const BLOCK_CSV_FILE = "GeoLite2-City-Blocks-IPv4.csv"
+const CITY_CSV_FILE = "GeoLite2-City-Locations-en.csv"
+
+var (
+	// ErrInvalidAddress is returned for a string that is not an IP address.
+	ErrInvalidAddress = errors.New("invalid IP address")
+	// ErrUnsupportedAddress is returned by the block and range databases
+	// for an IPv6 address.
+	ErrUnsupportedAddress = errors.New("unsupported IP address")
+	// ErrNotFound is returned when no block contains the address.
+	ErrNotFound = errors.New("no entry matched")
+)
+
+// LookupError is the error of a failed lookup.  Use errors.Is with
+// ErrInvalidAddress, ErrUnsupportedAddress and ErrNotFound to tell the
+// cause.
+type LookupError struct {
+	Addr string
+	Err  error
+}
+
+func (e *LookupError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Err, e.Addr)
+}
+
+func (e *LookupError) Unwrap() error {
+	return e.Err
+}
+
+// Location is the result of a lookup: the location of the address range
+// First-Last.  Network is the range as a CIDR block, if it is one.
+// Country and City are empty if they are not known.
+type Location struct {
+	First     netip.Addr   `json:"first"`
+	Last      netip.Addr   `json:"last"`
+	Network   netip.Prefix `json:"network"`
+	GeoID     int          `json:"geoname_id"`
+	Country   string       `json:"country"`
+	City      string       `json:"city"`
+	Latitude  float32      `json:"latitude"`
+	Longitude float32      `json:"longitude"`
+
+	// Source is SOURCE_OVERRIDE if the location is given by Overrides,
+	// with the Labels of the override.
+	Source string   `json:"source,omitempty"`
+	Labels []string `json:"labels,omitempty"`
+	// Category is the category of a special-purpose address (see
+	// Special), such as CATEGORY_PRIVATE, as labeled by Overlay.
+	Category string `json:"category,omitempty"`
+}
+
+// Lookuper looks up the location of an address.  The implementations in
+// this package may be used from multiple goroutines at once.
+type Lookuper interface {
+	Lookup(addr netip.Addr) (Location, error)
+}
+
+// Database is a loaded geolocation database of a backend (see
+// OpenBackend).
+type Database interface {
+	Lookuper
+	LookupIP(ip net.IP) (Location, error)
+	LookupString(s string) (Location, error)
+	Info() Info
+	// Walk calls fn with every range of the database in address order,
+	// until fn returns false.
+	Walk(fn func(Location) bool)
+}
+
+// Options of Open and OpenBackend.  The zero value opens a GeoLite2 City
+// CSV release.
+type Options struct {
+	BlockFile string // BLOCK_CSV_FILE if empty
+	CityFile  string // CITY_CSV_FILE if empty
+
+	// If set, reported in Info instead of the path and the build date
+	// guessed from it, e.g. for a downloaded database.
+	Source    string
+	BuildDate time.Time
+
+	// Snapshot is the path of a snapshot of the loaded tables of a GeoLite2
+	// City database.  If set, Open maps the snapshot into memory instead of
+	// loading the CSV files, if it was written from the same files, and
+	// otherwise writes it after loading them.
+	Snapshot string
+
+	// Workers is the number of goroutines parsing the block file;
+	// runtime.GOMAXPROCS if 0.
+	Workers int
+
+	// Logger receives the progress of loading; nothing is logged if nil.
+	Logger *log.Logger
+}
+
+func (o Options) logger() *log.Logger {
+	if o.Logger == nil {
+		return log.New(io.Discard, "", 0)
+	}
+	return o.Logger
+}
+
+// Open loads the city and the block databases in dir.
+func Open(dir string, opts Options) (*BlockDatabase, error) {
+	if opts.BlockFile == "" {
+		opts.BlockFile = BLOCK_CSV_FILE
+	}
+	if opts.CityFile == "" {
+		opts.CityFile = CITY_CSV_FILE
+	}
+	blockFile := filepath.Join(dir, opts.BlockFile)
+	cityFile := filepath.Join(dir, opts.CityFile)
+	logger := opts.logger()
+
+	var blockDB *BlockDatabase
+	if opts.Snapshot != "" {
+		db, err := openSnapshot(opts.Snapshot, blockFile, cityFile)
+		if err != nil {
+			logger.Printf("snapshot %v not used: %v", opts.Snapshot, err)
+		} else {
+			logger.Printf("snapshot %v mapped, %v bytes", opts.Snapshot, db.mapped)
+			blockDB = db
+		}
+	}
+	if blockDB == nil {
+		cityDB, err := newCityDatabase(cityFile, logger)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load city database: %v", err)
+		}
+		blockDB, err = newBlockDatabase(blockFile, cityDB, opts.workers(), logger)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load block database: %v", err)
+		}
+		blockDB.BuildDate = databaseBuildDate(blockFile)
+		if opts.Snapshot != "" {
+			if err := blockDB.writeSnapshot(opts.Snapshot, blockFile, cityFile); err != nil {
+				logger.Printf("cannot write snapshot: %v", err)
+			}
+		}
+	}
+	blockDB.Source = dir
+	blockDB.LoadedAt = time.Now()
+	opts.override(&blockDB.Source, &blockDB.BuildDate)
+	return blockDB, nil
+}
+
+func (o Options) workers() int {
+	if o.Workers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return o.Workers
+}
+
+func (o Options) override(source *string, buildDate *time.Time) {
+	if o.Source != "" {
+		*source = o.Source
+	}
+	if !o.BuildDate.IsZero() {
+		*buildDate = o.BuildDate
+	}
+}
+
+// Info describes a loaded database.
+type Info struct {
+	Backend   string    `json:"backend"`
+	Source    string    `json:"source"`
+	BuildDate time.Time `json:"build_date"`
+	Blocks    int       `json:"blocks"`
+	Cities    int       `json:"cities"`
+	// distinct locations of the blocks, if the backend dedups them
+	Locations int         `json:"locations,omitempty"`
+	Overrides int         `json:"overrides,omitempty"`
+	Memory    MemoryUsage `json:"memory"`
+	LoadedAt  time.Time   `json:"loaded_at"`
+}
+
+// MemoryUsage is the memory used by the tables of a loaded database, in
+// bytes.
+type MemoryUsage struct {
+	Ranges    int64 `json:"ranges"`
+	Locations int64 `json:"locations"`
+	Strings   int64 `json:"strings"`
+	Index     int64 `json:"index"`
+	// of the above, mapped from a snapshot file instead of allocated
+	Mapped int64 `json:"mapped,omitempty"`
+}
+
+// Total returns the memory used by all tables.
+func (m MemoryUsage) Total() int64 {
+	return m.Ranges + m.Locations + m.Strings + m.Index
+}
+
+func (i Info) String() string {
+	s := fmt.Sprintf("backend=%v source=%v build=%v blocks=%v cities=%v",
+		i.Backend, i.Source, i.BuildDate.Format("2006-01-02"), i.Blocks, i.Cities)
+	if i.Overrides > 0 {
+		s += fmt.Sprintf(" overrides=%v", i.Overrides)
+	}
+	if i.Locations > 0 {
+		s += fmt.Sprintf(" locations=%v", i.Locations)
+	}
+	if total := i.Memory.Total(); total > 0 {
+		s += fmt.Sprintf(" memory=%v", total)
+	}
+	return s + " loaded=" + i.LoadedAt.Format(time.RFC3339)
+}
+
+func (b *BlockDatabase) Info() Info {
+	info := Info{
+		Backend:   BACKEND_MAXMIND_CSV,
+		Source:    b.Source,
+		BuildDate: b.BuildDate,
+		Blocks:    len(b.begin),
+		Cities:    b.cities,
+		Locations: len(b.locations),
+		LoadedAt:  b.LoadedAt,
+	}
+	m := &info.Memory
+	m.Ranges = int64(cap(b.begin)+cap(b.end)+cap(b.loc)) * 4
+	m.Locations = int64(cap(b.locations)) * int64(unsafe.Sizeof(blockLocation{}))
+	m.Strings = int64(cap(b.names)) * int64(unsafe.Sizeof(""))
+	for _, name := range b.names {
+		m.Strings += int64(len(name))
+	}
+	if b.index != nil {
+		m.Index = b.index.MemoryBytes()
+	}
+	m.Mapped = b.mapped
+	return info
+}
+
+// Validate checks that a newly loaded database is usable, e.g. before it
+// replaces the current one.
+func Validate(db Database) error {
+	info := db.Info()
+	if info.Blocks == 0 {
+		return fmt.Errorf("no block in %v", info.Source)
+	}
+	if info.Cities == 0 {
+		return fmt.Errorf("no city in %v", info.Source)
+	}
+	located := 0
+	db.Walk(func(loc Location) bool {
+		if loc.Country != "" || loc.City != "" {
+			located++
+		}
+		return true
+	})
+	if located < info.Blocks/2 {
+		return fmt.Errorf("only %v of %v blocks have a location in %v", located, info.Blocks, info.Source)
+	}
+	return nil
+}
+
+// MaxMind names the directory in the archive after the build date,
+// e.g. GeoLite2-City-CSV_20171205.
+var buildDatePattern = regexp.MustCompile(`_([0-9]{8})$`)
+
+// ReleaseBuildDate returns the build date in the release name, such as
+// GeoLite2-City-CSV_20171205, or the zero time if there is none.
+func ReleaseBuildDate(name string) time.Time {
+	if m := buildDatePattern.FindStringSubmatch(filepath.Base(filepath.Clean(name))); m != nil {
+		if t, err := time.Parse("20060102", m[1]); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// databaseBuildDate guesses the build date of the block database, from
+// the name of its directory, or from its modification time.
+func databaseBuildDate(blockFile string) time.Time {
+	if t := ReleaseBuildDate(filepath.Dir(blockFile)); !t.IsZero() {
+		return t
+	}
+	if fi, err := os.Stat(blockFile); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// Handle holds the current database, which can be replaced as a whole
+// while lookups are in progress; they keep using the database they
+// started with.
+type Handle struct {
+	db atomic.Pointer[handleDatabase]
+}
+
+type handleDatabase struct {
+	Database
+}
+
+// NewHandle returns a Handle of db.
+func NewHandle(db Database) *Handle {
+	h := &Handle{}
+	h.Store(db)
+	return h
+}
+
+// Load returns the current database.
+func (h *Handle) Load() Database {
+	if p := h.db.Load(); p != nil {
+		return p.Database
+	}
+	return nil
+}
+
+// Store replaces the current database with db.
+func (h *Handle) Store(db Database) {
+	h.db.Store(&handleDatabase{db})
+}
+
+// Swap replaces the current database with db, and returns the old one.
+func (h *Handle) Swap(db Database) Database {
+	if p := h.db.Swap(&handleDatabase{db}); p != nil {
+		return p.Database
+	}
+	return nil
+}
+
+// Lookup looks up addr in the current database.
+func (h *Handle) Lookup(addr netip.Addr) (Location, error) {
+	return h.Load().Lookup(addr)
+}
@@ -0,0 +1,265 @@
+package geoip
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// DBIP_CSV_PATTERN matches the file of a DB-IP IP to City Lite release in
+// a directory given to OpenDBIP.
+const DBIP_CSV_PATTERN = "dbip-city-lite-*.csv"
+
+// DB-IP names the file after the month of the release, e.g.
+// dbip-city-lite-2024-01.csv.
+var dbipBuildDatePattern = regexp.MustCompile(`([0-9]{4}-[0-9]{2})\.csv$`)
+
+// RangeEntry is a range of addresses with its location, as in the
+// databases that are not organized in CIDR blocks.
+type RangeEntry struct {
+	IP4Range
+	Country   string
+	City      string
+	Latitude  float32
+	Longitude float32
+}
+
+// Location returns the location of the range.
+func (e RangeEntry) Location() Location {
+	loc := Location{
+		First:     e.First(),
+		Last:      e.Last(),
+		Country:   e.Country,
+		City:      e.City,
+		Latitude:  e.Latitude,
+		Longitude: e.Longitude,
+	}
+	if e.IsPrefix() {
+		loc.Network = e.Prefix()
+	}
+	return loc
+}
+
+// RangeDatabase is a database of address ranges sorted by their first
+// address, e.g. DB-IP IP to City Lite.
+type RangeDatabase struct {
+	Backend   string
+	Source    string
+	BuildDate time.Time
+	LoadedAt  time.Time
+	Entries   []RangeEntry
+	cities    int
+	nameBytes int64 // of the interned country and city names
+
+	index *Trie
+}
+
+// OpenDBIP loads a DB-IP IP to City Lite CSV file, or the latest one in
+// the directory path.  IPv6 ranges are skipped.
+func OpenDBIP(path string, opts Options) (*RangeDatabase, error) {
+	filename, err := dbipFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	logger := opts.logger()
+
+	db := &RangeDatabase{Backend: BACKEND_DBIP_CSV, Source: filename}
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	cities := map[[2]string]bool{}
+	names := map[string]string{}
+	intern := func(s string) string {
+		if n, ok := names[s]; ok {
+			return n
+		}
+		s = strings.Clone(s)
+		names[s] = s
+		db.nameBytes += int64(len(s))
+		return s
+	}
+	lineno := 0
+	ignored := 0
+	for {
+		lineno++
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry, err := parseDBIPRecord(record)
+		if err != nil {
+			ignored++
+			continue
+		}
+		entry.Country, entry.City = intern(entry.Country), intern(entry.City)
+		db.Entries = append(db.Entries, entry)
+		cities[[2]string{entry.Country, entry.City}] = true
+	}
+	logger.Printf("parsed %v lines, %v lines ignored", lineno-1, ignored)
+	db.cities = len(cities)
+
+	sort.Slice(db.Entries, func(i, j int) bool {
+		return db.Entries[i].Begin < db.Entries[j].Begin
+	})
+
+	if m := dbipBuildDatePattern.FindStringSubmatch(filename); m != nil {
+		db.BuildDate, _ = time.Parse("2006-01", m[1])
+	} else if fi, err := f.Stat(); err == nil {
+		db.BuildDate = fi.ModTime()
+	}
+	db.BuildIndex()
+	logger.Printf("index of %v prefixes built, %v bytes", db.index.Len(), db.index.MemoryBytes())
+	db.LoadedAt = time.Now()
+	opts.override(&db.Source, &db.BuildDate)
+	return db, nil
+}
+
+// BuildIndex builds the trie of the ranges, which the lookups use instead
+// of a binary search.  Call it again after changing Entries.
+func (db *RangeDatabase) BuildIndex() {
+	index := NewTrie()
+	for i := range db.Entries {
+		index.InsertRange(db.Entries[i].IP4Range, int32(i))
+	}
+	index.Compact()
+	db.index = index
+}
+
+// dbipFile returns path, or the latest release in it if it is a directory.
+func dbipFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return path, nil
+	}
+	matches, _ := filepath.Glob(filepath.Join(path, DBIP_CSV_PATTERN))
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no %v in %v", DBIP_CSV_PATTERN, path)
+	}
+	sort.Strings(matches)
+	return matches[len(matches)-1], nil
+}
+
+// parseDBIPRecord parses a line of ip_start, ip_end, continent, country,
+// stateprov, city, latitude and longitude.
+func parseDBIPRecord(record []string) (RangeEntry, error) {
+	var entry RangeEntry
+	if len(record) < 8 {
+		return entry, fmt.Errorf("expected 8 fields, got %v", len(record))
+	}
+	first, err := netip.ParseAddr(record[0])
+	if err != nil {
+		return entry, err
+	}
+	last, err := netip.ParseAddr(record[1])
+	if err != nil {
+		return entry, err
+	}
+	if entry.Begin, err = addrToUint32(first); err != nil {
+		return entry, err
+	}
+	if entry.End, err = addrToUint32(last); err != nil {
+		return entry, err
+	}
+	if entry.End < entry.Begin {
+		return entry, fmt.Errorf("invalid range %v-%v", first, last)
+	}
+	lat, err := strconv.ParseFloat(record[6], 32)
+	if err != nil {
+		return entry, err
+	}
+	lng, err := strconv.ParseFloat(record[7], 32)
+	if err != nil {
+		return entry, err
+	}
+	entry.Country = record[3]
+	entry.City = record[5]
+	entry.Latitude = float32(lat)
+	entry.Longitude = float32(lng)
+	return entry, nil
+}
+
+// Lookup returns the location of addr.
+func (db *RangeDatabase) Lookup(addr netip.Addr) (Location, error) {
+	target, err := addrToUint32(addr)
+	if err != nil {
+		return Location{}, err
+	}
+	idx := -1
+	if db.index != nil {
+		if i, ok := db.index.Lookup(addr); ok {
+			idx = int(i)
+		}
+	} else {
+		idx = searchSorted(db, target)
+	}
+	if idx < 0 {
+		return Location{}, &LookupError{Addr: addr.String(), Err: ErrNotFound}
+	}
+	return db.Entries[idx].Location(), nil
+}
+
+// LookupIP returns the location of ip.
+func (db *RangeDatabase) LookupIP(ip net.IP) (Location, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return Location{}, &LookupError{Addr: ip.String(), Err: ErrInvalidAddress}
+	}
+	return db.Lookup(addr)
+}
+
+// LookupString returns the location of the address in s.
+func (db *RangeDatabase) LookupString(s string) (Location, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return Location{}, &LookupError{Addr: s, Err: ErrInvalidAddress}
+	}
+	return db.Lookup(addr)
+}
+
+// Info describes the database; Cities is the number of distinct cities.
+func (db *RangeDatabase) Info() Info {
+	info := Info{
+		Backend:   db.Backend,
+		Source:    db.Source,
+		BuildDate: db.BuildDate,
+		Blocks:    len(db.Entries),
+		Cities:    db.cities,
+		LoadedAt:  db.LoadedAt,
+	}
+	info.Memory.Ranges = int64(cap(db.Entries)) * int64(unsafe.Sizeof(RangeEntry{}))
+	info.Memory.Strings = db.nameBytes
+	if db.index != nil {
+		info.Memory.Index = db.index.MemoryBytes()
+	}
+	return info
+}
+
+// Walk calls fn with the location of every range in address order, until
+// fn returns false.
+func (db *RangeDatabase) Walk(fn func(Location) bool) {
+	for i := range db.Entries {
+		if !fn(db.Entries[i].Location()) {
+			return
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package geoip
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testDBIPCSV = `1.0.0.0,1.0.0.255,OC,AU,Queensland,"South Brisbane",-27.4767,153.017
+3.3.3.0,3.3.3.99,NA,US,"New Jersey",Fairfield,40.8838,-74.306
+3.3.3.100,3.3.3.255,NA,US,"New Jersey",Newark,40.7357,-74.1724
+2001:db8::,2001:db8::ffff,EU,DE,Berlin,Berlin,52.5244,13.4105
+`
+
+func TestOpenBackend_DBIP(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "dbip-city-lite-2023-12.csv"), []byte("bogus\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "dbip-city-lite-2024-01.csv"), []byte(testDBIPCSV), 0644)
+
+	db, err := OpenBackend(BACKEND_DBIP_CSV, dir, Options{})
+	if err != nil {
+		t.Fatalf("cannot open the database: %v", err)
+	}
+	info := db.Info()
+	if info.Backend != BACKEND_DBIP_CSV || info.Blocks != 3 || info.Cities != 3 || info.BuildDate.Format("2006-01") != "2024-01" {
+		t.Errorf("unexpected info: %v", info)
+	}
+	if err := Validate(db); err != nil {
+		t.Errorf("validation failed: %v", err)
+	}
+
+	loc, err := db.LookupString("3.3.3.150")
+	if err != nil || loc.City != "Newark" || loc.First.String() != "3.3.3.100" || loc.Network.IsValid() {
+		t.Errorf("unexpected location: %+v, %v", loc, err)
+	}
+	loc, err = db.Lookup(netip.MustParseAddr("1.0.0.1"))
+	if err != nil || loc.Country != "AU" || loc.Network.String() != "1.0.0.0/24" {
+		t.Errorf("unexpected location: %+v, %v", loc, err)
+	}
+	if _, err := db.LookupString("2.0.0.1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("address in a gap found: %v", err)
+	}
+
+	if _, err := OpenBackend("bogus", dir, Options{}); err == nil {
+		t.Errorf("unknown backend opened")
+	}
+}
@@ -0,0 +1,191 @@
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime"
+	"sort"
+)
+
+// Kinds of the changed ranges reported by Diff.
+const (
+	DIFF_ADDED   = "added"
+	DIFF_REMOVED = "removed"
+	DIFF_COUNTRY = "country" // reassigned to another country
+	DIFF_CITY    = "city"    // reassigned to another city of the same country
+)
+
+// DiffEntry is a range of addresses that changed between two databases.
+// Old and New are the locations of the blocks that contain the range in
+// each database; Old is nil for DIFF_ADDED, New for DIFF_REMOVED.
+type DiffEntry struct {
+	Kind      string     `json:"kind"`
+	First     netip.Addr `json:"first"`
+	Last      netip.Addr `json:"last"`
+	Addresses uint64     `json:"addresses"`
+	Old       *Location  `json:"old,omitempty"`
+	New       *Location  `json:"new,omitempty"`
+}
+
+// CountryMove is the address space reassigned from one country to
+// another.  An empty country is unknown.
+type CountryMove struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Addresses uint64 `json:"addresses"`
+}
+
+// DiffCount is the number of ranges of a kind and their addresses.
+type DiffCount struct {
+	Ranges    int    `json:"ranges"`
+	Addresses uint64 `json:"addresses"`
+}
+
+// DiffSummary aggregates the changes between two databases.
+type DiffSummary struct {
+	Old     Info          `json:"old"`
+	New     Info          `json:"new"`
+	Added   DiffCount     `json:"added"`
+	Removed DiffCount     `json:"removed"`
+	Country DiffCount     `json:"country"`
+	City    DiffCount     `json:"city"`
+	Moves   []CountryMove `json:"moves"` // largest first
+}
+
+func (s *DiffSummary) add(e DiffEntry) {
+	var c *DiffCount
+	switch e.Kind {
+	case DIFF_ADDED:
+		c = &s.Added
+	case DIFF_REMOVED:
+		c = &s.Removed
+	case DIFF_COUNTRY:
+		c = &s.Country
+	case DIFF_CITY:
+		c = &s.City
+	}
+	c.Ranges++
+	c.Addresses += e.Addresses
+}
+
+// rangeList is a database of non-overlapping ranges sorted by their first
+// address, which Diff walks in step.
+type rangeList interface {
+	numRanges() int
+	rangeAt(i int) IP4Range
+	locationAt(i int) Location
+}
+
+func (b *BlockDatabase) numRanges() int            { return len(b.begin) }
+func (b *BlockDatabase) locationAt(i int) Location { return b.Entry(i).Location() }
+
+func (b *BlockDatabase) rangeAt(i int) IP4Range {
+	r := IP4Range{b.begin[i], b.end[i]}
+	runtime.KeepAlive(b) // see BlockDatabase.mapped
+	return r
+}
+
+func (db *RangeDatabase) numRanges() int            { return len(db.Entries) }
+func (db *RangeDatabase) rangeAt(i int) IP4Range    { return db.Entries[i].IP4Range }
+func (db *RangeDatabase) locationAt(i int) Location { return db.Entries[i].Location() }
+
+// Diff compares the ranges of the old and the new database, calls fn with
+// every range that was added, removed or reassigned to another location,
+// in address order, and returns the summary of the changes.  The ranges
+// are split where a block boundary of either database lies, so a block
+// that is split or merged in the new release, but keeps its location, is
+// not reported.
+func Diff(oldDB, newDB Database, fn func(DiffEntry)) (DiffSummary, error) {
+	summary := DiffSummary{Old: oldDB.Info(), New: newDB.Info()}
+	a, ok := oldDB.(rangeList)
+	if !ok {
+		return summary, fmt.Errorf("cannot diff the %v backend", summary.Old.Backend)
+	}
+	b, ok := newDB.(rangeList)
+	if !ok {
+		return summary, fmt.Errorf("cannot diff the %v backend", summary.New.Backend)
+	}
+
+	moves := map[[2]string]uint64{}
+	const end = uint64(1) << 32
+	i, j := 0, 0
+	for pos := uint64(0); pos < end; {
+		for i < a.numRanges() && uint64(a.rangeAt(i).End) < pos {
+			i++
+		}
+		for j < b.numRanges() && uint64(b.rangeAt(j).End) < pos {
+			j++
+		}
+		inA, nextA := coverage(a, i, pos)
+		inB, nextB := coverage(b, j, pos)
+		next := min(nextA, nextB)
+		if !inA && !inB {
+			pos = next
+			continue
+		}
+
+		e := DiffEntry{
+			First:     uint32ToAddr(uint32(pos)),
+			Last:      uint32ToAddr(uint32(next - 1)),
+			Addresses: next - pos,
+		}
+		var oldLoc, newLoc Location
+		if inA {
+			oldLoc = a.locationAt(i)
+		}
+		if inB {
+			newLoc = b.locationAt(j)
+		}
+		switch {
+		case !inA:
+			e.Kind = DIFF_ADDED
+		case !inB:
+			e.Kind = DIFF_REMOVED
+		case oldLoc.Country != newLoc.Country:
+			e.Kind = DIFF_COUNTRY
+			moves[[2]string{oldLoc.Country, newLoc.Country}] += e.Addresses
+		case oldLoc.City != newLoc.City:
+			e.Kind = DIFF_CITY
+		}
+		if e.Kind != "" {
+			if inA {
+				e.Old = &oldLoc
+			}
+			if inB {
+				e.New = &newLoc
+			}
+			summary.add(e)
+			if fn != nil {
+				fn(e)
+			}
+		}
+		pos = next
+	}
+
+	summary.Moves = []CountryMove{}
+	for k, n := range moves {
+		summary.Moves = append(summary.Moves, CountryMove{From: k[0], To: k[1], Addresses: n})
+	}
+	sort.Slice(summary.Moves, func(i, j int) bool {
+		mi, mj := summary.Moves[i], summary.Moves[j]
+		if mi.Addresses != mj.Addresses {
+			return mi.Addresses > mj.Addresses
+		}
+		return mi.From+mi.To < mj.From+mj.To
+	})
+	return summary, nil
+}
+
+// coverage reports whether the i-th range of l contains pos, and returns
+// the address after the end of that range, or the first address of the
+// next range if pos is in a gap.
+func coverage(l rangeList, i int, pos uint64) (bool, uint64) {
+	if i >= l.numRanges() {
+		return false, uint64(1) << 32
+	}
+	r := l.rangeAt(i)
+	if uint64(r.Begin) > pos {
+		return false, uint64(r.Begin)
+	}
+	return true, uint64(r.End) + 1
+}
@@ -0,0 +1,217 @@
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+const testCityCSV = `geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,subdivision_1_iso_code,subdivision_1_name,subdivision_2_iso_code,subdivision_2_name,city_name,metro_code,time_zone
+1850147,en,AS,Asia,JP,Japan,13,Tokyo,,,Tokyo,,Asia/Tokyo
+5097315,en,NA,"North America",US,"United States",NJ,"New Jersey",,,Fairfield,501,America/New_York
+`
+
+const testBlockCSV = `network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,postal_code,latitude,longitude,accuracy_radius
+3.3.3.0/24,5097315,6252001,,0,0,07004,40.8838,-74.3060,1000
+111.111.0.0/16,1850147,1861060,,0,0,,35.6850,139.7514,500
+`
+
+func openTestDatabase(t *testing.T) *BlockDatabase {
+	dir := filepath.Join(t.TempDir(), "GeoLite2-City-CSV_20180102")
+	os.Mkdir(dir, 0755)
+	os.WriteFile(filepath.Join(dir, CITY_CSV_FILE), []byte(testCityCSV), 0644)
+	os.WriteFile(filepath.Join(dir, BLOCK_CSV_FILE), []byte(testBlockCSV), 0644)
+
+	db, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("cannot open the database: %v", err)
+	}
+	return db
+}
+
+func TestOpen(t *testing.T) {
+	db := openTestDatabase(t)
+	info := db.Info()
+	if info.Blocks != 2 || info.Cities != 2 || info.BuildDate.Format("20060102") != "20180102" {
+		t.Errorf("unexpected info: %v", info)
+	}
+	if err := Validate(db); err != nil {
+		t.Errorf("validation failed: %v", err)
+	}
+	if _, err := Open(t.TempDir(), Options{}); err == nil {
+		t.Errorf("empty directory opened")
+	}
+}
+
+func TestOpen_Snapshot(t *testing.T) {
+	db := openTestDatabase(t)
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+	opts := Options{Snapshot: snapshot}
+	written, err := Open(db.Source, opts)
+	if err != nil || written.mapped != 0 {
+		t.Fatalf("cannot write the snapshot: %v", err)
+	}
+	mapped, err := Open(db.Source, opts)
+	if err != nil {
+		t.Fatalf("cannot map the snapshot: %v", err)
+	}
+	if runtime.GOOS != "windows" && mapped.Info().Memory.Mapped == 0 {
+		t.Errorf("snapshot not mapped: %+v", mapped.Info())
+	}
+	if a, b := db.Info(), mapped.Info(); a.Blocks != b.Blocks || a.Cities != b.Cities ||
+		a.Locations != b.Locations || !a.BuildDate.Equal(b.BuildDate) {
+		t.Errorf("info %v, mapped %v", a, b)
+	}
+	for i := 0; i < db.Len(); i++ {
+		if e1, e2 := db.Entry(i), mapped.Entry(i); e1 != e2 {
+			t.Errorf("block %v: %v, mapped %v", i, e1, e2)
+		}
+	}
+
+	// a snapshot of other files is written again
+	os.WriteFile(filepath.Join(db.Source, BLOCK_CSV_FILE), []byte(testBlockCSV+"1.0.0.0/24,1850147,,,0,0,,35.6850,139.7514,500\n"), 0644)
+	db, err = Open(db.Source, opts)
+	if err != nil || db.mapped != 0 || db.Len() != 3 {
+		t.Errorf("stale snapshot used: %v", err)
+	}
+}
+
+func TestOpen_SnapshotReload(t *testing.T) {
+	db := openTestDatabase(t)
+	opts := Options{Snapshot: filepath.Join(t.TempDir(), "snapshot")}
+	if _, err := Open(db.Source, opts); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandle(db)
+
+	// the replaced snapshots are unmapped by the collections while the
+	// lookups holding them are still reading
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				loc, err := h.Load().Lookup(netip.MustParseAddr("111.111.111.111"))
+				if err != nil || loc.City != "Tokyo" {
+					t.Errorf("unexpected location: %+v, %v", loc, err)
+					return
+				}
+				h.Load().(*BlockDatabase).Walk(func(Location) bool { return true })
+				runtime.Gosched()
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		mapped, err := Open(db.Source, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Store(mapped)
+		runtime.GC()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestLookup(t *testing.T) {
+	var db Database = openTestDatabase(t)
+
+	loc, err := db.Lookup(netip.MustParseAddr("111.111.111.111"))
+	if err != nil || loc.Country != "JP" || loc.City != "Tokyo" || loc.Network.String() != "111.111.0.0/16" {
+		t.Errorf("unexpected location: %+v, %v", loc, err)
+	}
+	loc, err = db.LookupIP(net.ParseIP("3.3.3.3"))
+	if err != nil || loc.City != "Fairfield" || loc.Latitude != 40.8838 {
+		t.Errorf("unexpected location: %+v, %v", loc, err)
+	}
+	loc, err = db.Lookup(netip.MustParseAddr("::ffff:3.3.3.3"))
+	if err != nil || loc.City != "Fairfield" {
+		t.Errorf("IPv4-mapped address not found: %+v, %v", loc, err)
+	}
+	if PrefixRange(loc.Network).String() != "3.3.3.0-3.3.3.255" {
+		t.Errorf("unexpected range: %v", PrefixRange(loc.Network))
+	}
+
+	cases := []struct {
+		addr string
+		err  error
+	}{
+		{"bogus", ErrInvalidAddress},
+		{"2001:db8::1", ErrUnsupportedAddress},
+		{"200.0.0.1", ErrNotFound},
+		{"9.9.9.9", ErrNotFound}, // between two blocks
+	}
+	for _, c := range cases {
+		_, err := db.LookupString(c.addr)
+		var le *LookupError
+		if !errors.Is(err, c.err) || !errors.As(err, &le) || le.Addr != c.addr {
+			t.Errorf("%v: expected %v, got %v", c.addr, c.err, err)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	db := openTestDatabase(t)
+	var h Lookuper = NewHandle(db)
+	if _, err := h.Lookup(netip.MustParseAddr("3.3.3.3")); err != nil {
+		t.Errorf("lookup through the handle failed: %v", err)
+	}
+	if old := h.(*Handle).Swap(&BlockDatabase{}); old != db {
+		t.Errorf("Swap returned %v", old)
+	}
+	if _, err := h.Lookup(netip.MustParseAddr("3.3.3.3")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("swapped database not used: %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	oldDB := openTestDatabase(t)
+	newDB := &RangeDatabase{Entries: []RangeEntry{
+		// 3.3.3.0/24 split, the upper half moved to Newark
+		{IP4Range: IP4Range{Begin: 0x03030300, End: 0x0303037f}, Country: "US", City: "Fairfield"},
+		{IP4Range: IP4Range{Begin: 0x03030380, End: 0x030303ff}, Country: "US", City: "Newark"},
+		// 111.111.0.0/16 shrunk to /17, and the rest moved to Korea
+		{IP4Range: IP4Range{Begin: 0x6f6f0000, End: 0x6f6f7fff}, Country: "JP", City: "Tokyo"},
+		{IP4Range: IP4Range{Begin: 0x6f6f8000, End: 0x6f6fbfff}, Country: "KR", City: "Seoul"},
+		{IP4Range: IP4Range{Begin: 0xc8000000, End: 0xc80000ff}, Country: "DE", City: "Berlin"},
+	}}
+
+	var entries []DiffEntry
+	summary, err := Diff(oldDB, newDB, func(e DiffEntry) {
+		entries = append(entries, e)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"city 3.3.3.128-3.3.3.255 128",
+		"country 111.111.128.0-111.111.191.255 16384",
+		"removed 111.111.192.0-111.111.255.255 16384",
+		"added 200.0.0.0-200.0.0.255 256",
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("unexpected diff: %+v", entries)
+	}
+	for i, e := range entries {
+		if s := fmt.Sprintf("%v %v-%v %v", e.Kind, e.First, e.Last, e.Addresses); s != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], s)
+		}
+	}
+	if summary.Country.Addresses != 16384 || summary.Added.Ranges != 1 || summary.Removed.Addresses != 16384 ||
+		len(summary.Moves) != 1 || summary.Moves[0] != (CountryMove{From: "JP", To: "KR", Addresses: 16384}) {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+}
@@ -0,0 +1,99 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"net/netip"
+)
+
+type IP4Range struct {
+	Begin uint32
+	End   uint32
+}
+
+func NewIP4Range(cidr string) (IP4Range, error) {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return IP4Range{}, err
+	}
+	addr, nbits := p.Addr(), p.Bits()
+	if addr.Is4In6() && nbits >= 96 {
+		addr, nbits = addr.Unmap(), nbits-96
+	}
+	if !addr.Is4() {
+		return IP4Range{}, fmt.Errorf("not an IPv4 network: %v", cidr)
+	}
+
+	a := addr.As4()
+	mask := ^uint32(0) << (32 - nbits)
+	begin := binary.BigEndian.Uint32(a[:]) & mask
+	end := begin | ^mask
+
+	return IP4Range{Begin: begin, End: end}, nil
+}
+
+func (r IP4Range) String() string {
+	return fmt.Sprintf("%s-%s", Uint32ToIP(r.Begin), Uint32ToIP(r.End))
+}
+
+// Prefix returns the range as a CIDR prefix.  The ranges made by
+// NewIP4Range are always CIDR blocks; for the others, see IsPrefix.
+func (r IP4Range) Prefix() netip.Prefix {
+	return netip.PrefixFrom(uint32ToAddr(r.Begin), 32-bits.Len32(r.End-r.Begin))
+}
+
+// IsPrefix reports whether the range is a CIDR block.
+func (r IP4Range) IsPrefix() bool {
+	size := r.End - r.Begin + 1
+	return size&(size-1) == 0 && r.Begin&(size-1) == 0
+}
+
+// First returns the first address of the range.
+func (r IP4Range) First() netip.Addr {
+	return uint32ToAddr(r.Begin)
+}
+
+// Last returns the last address of the range.
+func (r IP4Range) Last() netip.Addr {
+	return uint32ToAddr(r.End)
+}
+
+func uint32ToAddr(n uint32) netip.Addr {
+	var a [4]byte
+	binary.BigEndian.PutUint32(a[:], n)
+	return netip.AddrFrom4(a)
+}
+
+// addrToUint32 returns the IPv4 (or IPv4-mapped) address as an integer.
+func addrToUint32(addr netip.Addr) (uint32, error) {
+	addr = addr.Unmap()
+	if !addr.Is4() {
+		return 0, &LookupError{Addr: addr.String(), Err: ErrUnsupportedAddress}
+	}
+	a4 := addr.As4()
+	return binary.BigEndian.Uint32(a4[:]), nil
+}
+
+// PrefixRange returns the range of the IPv4 prefix p.
+func PrefixRange(p netip.Prefix) IP4Range {
+	a := p.Masked().Addr().As4()
+	begin := binary.BigEndian.Uint32(a[:])
+	return IP4Range{Begin: begin, End: begin | (1<<(32-p.Bits()) - 1)}
+}
+
+// IPToUint32 returns the IPv4 address ip as an integer.
+func IPToUint32(ip net.IP) uint32 {
+	if len(ip) == 16 {
+		return binary.BigEndian.Uint32(ip[12:16])
+	}
+	return binary.BigEndian.Uint32(ip)
+}
+
+// Uint32ToIP returns the IPv4 address of the integer nn.
+func Uint32ToIP(nn uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, nn)
+	return ip
+}
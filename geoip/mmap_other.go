@@ -0,0 +1,11 @@
+//go:build !unix
+
+package geoip
+
+import "os"
+
+// mapFile reads filename, where memory mapping is not supported.
+func mapFile(filename string) ([]byte, func(), error) {
+	data, err := os.ReadFile(filename)
+	return data, nil, err
+}
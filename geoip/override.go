@@ -0,0 +1,351 @@
+package geoip
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SOURCE_OVERRIDE is the Source of the locations given by Overrides.
+const SOURCE_OVERRIDE = "override"
+
+// Override is the location of a network that takes precedence over the
+// database, e.g. a corporate or VPN network.
+type Override struct {
+	Network   netip.Prefix
+	Country   string
+	City      string
+	Latitude  float32
+	Longitude float32
+	Labels    []string
+}
+
+// Location returns the location of an address in the network.
+func (o *Override) Location() Location {
+	loc := Location{
+		Network:   o.Network,
+		Country:   o.Country,
+		City:      o.City,
+		Latitude:  o.Latitude,
+		Longitude: o.Longitude,
+		Source:    SOURCE_OVERRIDE,
+		Labels:    o.Labels,
+	}
+	loc.First, loc.Last = prefixBounds(o.Network)
+	return loc
+}
+
+// prefixBounds returns the first and the last address of p.
+func prefixBounds(p netip.Prefix) (netip.Addr, netip.Addr) {
+	first := p.Masked().Addr()
+	last := first.AsSlice()
+	for i := p.Bits(); i < len(last)*8; i++ {
+		last[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(last)
+	return first, addr
+}
+
+// Overrides is a set of overrides, of which the longest prefix containing
+// an address wins.
+type Overrides struct {
+	Source  string
+	Entries []*Override
+
+	index *Trie
+}
+
+// NewOverrides returns the set of entries; a later entry replaces an
+// earlier one of the same network.
+func NewOverrides(entries []*Override) *Overrides {
+	o := &Overrides{Entries: entries, index: NewTrie()}
+	for i, e := range entries {
+		o.index.Insert(e.Network, int32(i))
+	}
+	o.index.Compact()
+	return o
+}
+
+// Lookup returns the override of the longest network containing addr.
+// A nil Overrides has none.
+func (o *Overrides) Lookup(addr netip.Addr) (*Override, bool) {
+	if o == nil {
+		return nil, false
+	}
+	if i, ok := o.index.Lookup(addr); ok {
+		return o.Entries[i], true
+	}
+	return nil, false
+}
+
+// LoadOverrides reads the overrides from a CSV file, or from a YAML file
+// if its name ends with .yaml or .yml.
+//
+// The CSV file has the columns network, country, city, latitude,
+// longitude and labels (separated by ";"), and an optional header line.
+// The YAML file is a list of mappings with the same keys, and labels as a
+// list, optionally under a top-level "overrides" key; only this simple
+// form of YAML is supported.
+func LoadOverrides(filename string) (*Overrides, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*Override
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		entries, err = parseOverridesYAML(f)
+	default:
+		entries, err = parseOverridesCSV(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	o := NewOverrides(entries)
+	o.Source = filename
+	return o, nil
+}
+
+func parseOverridesCSV(r io.Reader) ([]*Override, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	var entries []*Override
+	for lineno := 1; ; lineno++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if lineno == 1 && record[0] == "network" {
+			continue
+		}
+		fields := map[string]string{}
+		for i, key := range []string{"network", "country", "city", "latitude", "longitude", "labels"} {
+			if i < len(record) {
+				fields[key] = record[i]
+			}
+		}
+		e, err := newOverride(fields, strings.Split(fields["labels"], ";"))
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func parseOverridesYAML(r io.Reader) ([]*Override, error) {
+	var entries []*Override
+	var fields map[string]string
+	var labels []string
+	var item int
+	flush := func() error {
+		if fields == nil {
+			return nil
+		}
+		e, err := newOverride(fields, labels)
+		if err != nil {
+			return fmt.Errorf("item %v: %v", item, err)
+		}
+		entries = append(entries, e)
+		fields, labels = nil, nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	inLabels := false
+	itemIndent := -1 // indentation of the list items, set by the first one
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := yamlStripComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if itemIndent < 0 && indent == 0 && trimmed == "overrides:" {
+			// the list may also be the value of a top-level key
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") && (itemIndent < 0 || indent == itemIndent) {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			item++
+			itemIndent = indent
+			fields = map[string]string{}
+			inLabels = false
+			trimmed = strings.TrimSpace(trimmed[2:])
+		} else if strings.HasPrefix(trimmed, "- ") && inLabels && indent > itemIndent {
+			labels = append(labels, yamlScalar(trimmed[2:]))
+			continue
+		}
+		if fields == nil {
+			return nil, fmt.Errorf("line %v: expected a list item", lineno)
+		}
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %v: expected a key and a value", lineno)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		inLabels = key == "labels" && value == ""
+		if key == "labels" {
+			if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+				for _, l := range strings.Split(value[1:len(value)-1], ",") {
+					labels = append(labels, yamlScalar(l))
+				}
+			} else if value != "" {
+				labels = append(labels, yamlScalar(value))
+			}
+			continue
+		}
+		fields[key] = yamlScalar(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// yamlStripComment returns line without its comment: a '#' at the start
+// or after a space, outside of the quoted scalars.
+func yamlStripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t[,", line[i-1]) >= 0):
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// yamlScalar returns the value of a plain or quoted scalar.
+func yamlScalar(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		if s[0] == '"' {
+			if u, err := strconv.Unquote(s); err == nil {
+				return u
+			}
+		}
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// newOverride returns the override of the fields network, country, city,
+// latitude and longitude.  The network may be a single address.
+func newOverride(fields map[string]string, labels []string) (*Override, error) {
+	network := fields["network"]
+	if network == "" {
+		return nil, fmt.Errorf("no network")
+	}
+	p, err := netip.ParsePrefix(network)
+	if err != nil {
+		addr, aerr := netip.ParseAddr(network)
+		if aerr != nil {
+			return nil, fmt.Errorf("invalid network %q", network)
+		}
+		p = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	e := &Override{Network: p.Masked(), Country: fields["country"], City: fields["city"]}
+	for _, c := range []struct {
+		key string
+		v   *float32
+	}{{"latitude", &e.Latitude}, {"longitude", &e.Longitude}} {
+		if s := fields[c.key]; s != "" {
+			f, err := strconv.ParseFloat(s, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %v %q", c.key, s)
+			}
+			*c.v = float32(f)
+		}
+	}
+	for _, l := range labels {
+		if l = strings.TrimSpace(l); l != "" {
+			e.Labels = append(e.Labels, l)
+		}
+	}
+	return e, nil
+}
+
+// Overlay is a database whose lookups are overridden by Overrides, if not
+// nil, and which labels the special-purpose addresses with their
+// Category.  Both also apply to IPv6 addresses, which the database may
+// not support.  Walk describes the database only.
+type Overlay struct {
+	Database
+	Overrides *Overrides
+}
+
+// Lookup returns the location of addr from the overrides, the location of
+// its special-purpose network without a country or city, or the location
+// from the database, in this order.
+func (o *Overlay) Lookup(addr netip.Addr) (Location, error) {
+	special, isSpecial := Special(addr)
+	if e, ok := o.Overrides.Lookup(addr); ok {
+		loc := e.Location()
+		loc.Category = special.Category
+		return loc, nil
+	}
+	if isSpecial {
+		return special.Location(), nil
+	}
+	return o.Database.Lookup(addr)
+}
+
+// LookupIP returns the location of ip.
+func (o *Overlay) LookupIP(ip net.IP) (Location, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return Location{}, &LookupError{Addr: ip.String(), Err: ErrInvalidAddress}
+	}
+	return o.Lookup(addr)
+}
+
+// LookupString returns the location of the address in s.
+func (o *Overlay) LookupString(s string) (Location, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return Location{}, &LookupError{Addr: s, Err: ErrInvalidAddress}
+	}
+	return o.Lookup(addr)
+}
+
+// Info describes the database, and the number of overrides.
+func (o *Overlay) Info() Info {
+	info := o.Database.Info()
+	if o.Overrides != nil {
+		info.Overrides = len(o.Overrides.Entries)
+	}
+	return info
+}
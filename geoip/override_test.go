@@ -0,0 +1,118 @@
+package geoip
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testOverridesCSV = `network,country,city,latitude,longitude,labels
+# the VPN, and its gateway in Seoul
+3.0.0.0/8,US,Corp VPN,37.3861,-122.0839,corp;vpn
+3.3.3.3,KR,Seoul,37.5665,126.978,corp
+2001:db8::/32,DE,Berlin,52.5244,13.4105,
+`
+
+const testOverridesYAML = `# corrections
+- network: 3.0.0.0/8
+  country: US
+  city: "Corp VPN"
+  latitude: 37.3861
+  longitude: -122.0839
+  labels: [corp, vpn]
+- network: 3.3.3.3
+  country: KR
+  city: Seoul
+  labels:
+    - corp
+- network: 2001:db8::/32
+  country: DE
+  city: Berlin  # office
+`
+
+func TestLoadOverrides(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"overrides.csv": testOverridesCSV, "overrides.yaml": testOverridesYAML} {
+		filename := filepath.Join(dir, name)
+		os.WriteFile(filename, []byte(content), 0644)
+		o, err := LoadOverrides(filename)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if len(o.Entries) != 3 {
+			t.Fatalf("%v: unexpected overrides: %+v", name, o.Entries)
+		}
+
+		db := &Overlay{Database: openTestDatabase(t), Overrides: o}
+		cases := []struct {
+			addr, city, labels, source string
+		}{
+			{"3.3.3.3", "Seoul", "corp", SOURCE_OVERRIDE},
+			{"3.3.3.4", "Corp VPN", "corp,vpn", SOURCE_OVERRIDE},
+			{"::ffff:3.3.3.4", "Corp VPN", "corp,vpn", SOURCE_OVERRIDE},
+			{"2001:db8::1", "Berlin", "", SOURCE_OVERRIDE},
+			{"111.111.1.1", "Tokyo", "", ""},
+		}
+		for _, c := range cases {
+			loc, err := db.LookupString(c.addr)
+			if err != nil || loc.City != c.city || strings.Join(loc.Labels, ",") != c.labels || loc.Source != c.source {
+				t.Errorf("%v: %v: unexpected location: %+v, %v", name, c.addr, loc, err)
+			}
+		}
+		if loc, _ := db.LookupString("3.3.3.3"); loc.Network.String() != "3.3.3.3/32" || loc.Last != loc.First {
+			t.Errorf("%v: unexpected network: %+v", name, loc)
+		}
+		if info := db.Info(); info.Overrides != 3 || info.Blocks != 2 {
+			t.Errorf("%v: unexpected info: %v", name, info)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.csv")
+	os.WriteFile(bad, []byte("3.3.3.0/24,US,Fairfield\nbogus,US,Fairfield\n"), 0644)
+	if _, err := LoadOverrides(bad); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("invalid network accepted: %v", err)
+	}
+}
+
+func TestParseOverridesYAML(t *testing.T) {
+	tests := []struct {
+		yaml   string
+		cities []string
+	}{
+		// '#' inside quotes is not a comment
+		{"- network: 3.0.0.0/8\n  city: \"Office #2\"  # Seoul\n- network: 3.3.3.3\n  city: 'VPN #1'\n", []string{"Office #2", "VPN #1"}},
+		{"- network: 3.0.0.0/8\n  city: O'Hare # Chicago\n", []string{"O'Hare"}},
+		{"- network: 3.0.0.0/8\n  city: Seoul#2\n", []string{"Seoul#2"}},
+		// indented items under a top-level key
+		{"overrides:\n  - network: 3.0.0.0/8\n    city: Seoul\n    labels:\n      - corp\n  - network: 3.3.3.3\n    city: Tokyo\n", []string{"Seoul", "Tokyo"}},
+		{"overrides:\n- network: 3.0.0.0/8\n  city: Seoul\n  labels:\n  - corp\n", []string{"Seoul"}},
+	}
+	for _, test := range tests {
+		entries, err := parseOverridesYAML(strings.NewReader(test.yaml))
+		if err != nil {
+			t.Errorf("%q: %v", test.yaml, err)
+			continue
+		}
+		var cities []string
+		for _, e := range entries {
+			cities = append(cities, e.City)
+		}
+		if strings.Join(cities, ",") != strings.Join(test.cities, ",") {
+			t.Errorf("%q: unexpected cities: %q", test.yaml, cities)
+		}
+	}
+
+	entries, err := parseOverridesYAML(strings.NewReader("overrides:\n  - network: 3.0.0.0/8\n    labels:\n      - corp\n      - 'vpn # 1'\n"))
+	if err != nil || len(entries) != 1 || strings.Join(entries[0].Labels, ",") != "corp,vpn # 1" {
+		t.Errorf("unexpected labels: %+v, %v", entries, err)
+	}
+}
+
+func TestPrefixBounds(t *testing.T) {
+	first, last := prefixBounds(netip.MustParsePrefix("10.1.2.0/23"))
+	if first.String() != "10.1.2.0" || last.String() != "10.1.3.255" {
+		t.Errorf("unexpected bounds: %v-%v", first, last)
+	}
+}
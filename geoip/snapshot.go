@@ -0,0 +1,226 @@
+package geoip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+	"unsafe"
+)
+
+// SNAPSHOT_MAGIC begins a snapshot of the tables of a BlockDatabase (see
+// Options.Snapshot).  The tables follow the header in the byte order of
+// the host, so that the lookups use them where they are mapped.
+const SNAPSHOT_MAGIC = "GOIPSNP1"
+
+const snapshotByteOrder = 0x0102030405060708
+
+// snapshotHeader is followed by the begin, end and loc arrays of the
+// blocks, the locations, the offsets of the names and the names.
+type snapshotHeader struct {
+	Magic     [8]byte
+	ByteOrder uint64
+	BuildDate int64 // in unix nanoseconds, or 0
+
+	// the CSV files the snapshot was written from
+	BlockSize, BlockModTime int64
+	CitySize, CityModTime   int64
+
+	Blocks, Locations, Names, NameBytes, Cities int64
+}
+
+// fileStamp returns the size and the modification time of filename.
+func fileStamp(filename string) (int64, int64, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	return fi.Size(), fi.ModTime().UnixNano(), nil
+}
+
+func (b *BlockDatabase) newSnapshotHeader(blockFile, cityFile string) (snapshotHeader, error) {
+	h := snapshotHeader{
+		ByteOrder: snapshotByteOrder,
+		Blocks:    int64(len(b.begin)),
+		Locations: int64(len(b.locations)),
+		Names:     int64(len(b.names)),
+		Cities:    int64(b.cities),
+	}
+	copy(h.Magic[:], SNAPSHOT_MAGIC)
+	if !b.BuildDate.IsZero() {
+		h.BuildDate = b.BuildDate.UnixNano()
+	}
+	for _, name := range b.names {
+		h.NameBytes += int64(len(name))
+	}
+	var err error
+	if h.BlockSize, h.BlockModTime, err = fileStamp(blockFile); err != nil {
+		return h, err
+	}
+	if h.CitySize, h.CityModTime, err = fileStamp(cityFile); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+// writeSnapshot writes the tables of the database to filename, replacing
+// it by a rename so that a mapped older snapshot stays intact.
+func (b *BlockDatabase) writeSnapshot(filename, blockFile, cityFile string) error {
+	h, err := b.newSnapshotHeader(blockFile, cityFile)
+	if err != nil {
+		return err
+	}
+	offsets := make([]uint32, 0, len(b.names)+1)
+	offset := uint32(0)
+	for _, name := range b.names {
+		offsets = append(offsets, offset)
+		offset += uint32(len(name))
+	}
+	offsets = append(offsets, offset)
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	binary.Write(w, binary.NativeEndian, &h)
+	w.Write(sliceBytes(b.begin))
+	w.Write(sliceBytes(b.end))
+	w.Write(sliceBytes(b.loc))
+	w.Write(sliceBytes(b.locations))
+	w.Write(sliceBytes(offsets))
+	for _, name := range b.names {
+		w.WriteString(name)
+	}
+	err = w.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// openSnapshot maps the snapshot in filename, if it was written from the
+// CSV files as they are now.  The mapping is released with the database,
+// once no lookup uses it (see BlockDatabase.mapped).
+func openSnapshot(filename, blockFile, cityFile string) (*BlockDatabase, error) {
+	data, unmap, err := mapFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	db, err := parseSnapshot(data, blockFile, cityFile)
+	if err != nil {
+		if unmap != nil {
+			unmap()
+		}
+		return nil, err
+	}
+	if unmap != nil {
+		db.mapped = int64(cap(db.begin)+cap(db.end)+cap(db.loc))*4 +
+			int64(cap(db.locations))*int64(unsafe.Sizeof(blockLocation{}))
+		runtime.AddCleanup(db, func(unmap func()) { unmap() }, unmap)
+	}
+	db.BuildIndex()
+	return db, nil
+}
+
+func parseSnapshot(data []byte, blockFile, cityFile string) (*BlockDatabase, error) {
+	var h snapshotHeader
+	if err := binary.Read(bytes.NewReader(data), binary.NativeEndian, &h); err != nil ||
+		string(h.Magic[:]) != SNAPSHOT_MAGIC {
+		return nil, fmt.Errorf("not a snapshot")
+	}
+	if h.ByteOrder != snapshotByteOrder {
+		return nil, fmt.Errorf("snapshot of another byte order")
+	}
+	var stamp snapshotHeader
+	var err error
+	if stamp.BlockSize, stamp.BlockModTime, err = fileStamp(blockFile); err != nil {
+		return nil, err
+	}
+	if stamp.CitySize, stamp.CityModTime, err = fileStamp(cityFile); err != nil {
+		return nil, err
+	}
+	if h.BlockSize != stamp.BlockSize || h.BlockModTime != stamp.BlockModTime ||
+		h.CitySize != stamp.CitySize || h.CityModTime != stamp.CityModTime {
+		return nil, fmt.Errorf("snapshot of other CSV files")
+	}
+
+	db := &BlockDatabase{cities: int(h.Cities)}
+	if h.BuildDate != 0 {
+		db.BuildDate = time.Unix(0, h.BuildDate)
+	}
+	off := int(unsafe.Sizeof(h))
+	var offsets []uint32
+	var names []byte
+	for _, err := range []error{
+		sliceAt(data, &off, h.Blocks, &db.begin),
+		sliceAt(data, &off, h.Blocks, &db.end),
+		sliceAt(data, &off, h.Blocks, &db.loc),
+		sliceAt(data, &off, h.Locations, &db.locations),
+		sliceAt(data, &off, h.Names+1, &offsets),
+		sliceAt(data, &off, h.NameBytes, &names),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the names are copied, as the locations looked up may outlive the
+	// mapping
+	db.names = make([]string, h.Names)
+	for i := range db.names {
+		if offsets[i] > offsets[i+1] || int64(offsets[i+1]) > h.NameBytes {
+			return nil, fmt.Errorf("corrupted snapshot names")
+		}
+		db.names[i] = string(names[offsets[i]:offsets[i+1]])
+	}
+	for i, l := range db.loc {
+		if int64(l) >= h.Locations || db.end[i] < db.begin[i] {
+			return nil, fmt.Errorf("corrupted snapshot block %v", i)
+		}
+	}
+	for _, l := range db.locations {
+		if int64(l.Country) >= h.Names || int64(l.City) >= h.Names {
+			return nil, fmt.Errorf("corrupted snapshot location %v", l.GeoID)
+		}
+	}
+	return db, nil
+}
+
+// sliceBytes returns the memory of s.
+func sliceBytes[T any](s []T) []byte {
+	if len(s) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(&s[0])), len(s)*int(unsafe.Sizeof(s[0])))
+}
+
+// sliceAt sets s to the n elements in data at *off, in place, and
+// advances *off past them.
+func sliceAt[T any](data []byte, off *int, n int64, s *[]T) error {
+	var zero T
+	size := int64(unsafe.Sizeof(zero))
+	if n < 0 || int64(*off)+n*size > int64(len(data)) {
+		return fmt.Errorf("truncated snapshot")
+	}
+	if n == 0 {
+		*s = nil
+		return nil
+	}
+	p := unsafe.Pointer(&data[*off])
+	if uintptr(p)%unsafe.Alignof(zero) != 0 {
+		return fmt.Errorf("misaligned snapshot")
+	}
+	*s = unsafe.Slice((*T)(p), n)
+	*off += int(n * size)
+	return nil
+}
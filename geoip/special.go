@@ -0,0 +1,105 @@
+package geoip
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// Categories of the special-purpose addresses, after the IANA IPv4 and
+// IPv6 Special-Purpose Address Registries.
+const (
+	CATEGORY_PRIVATE       = "PRIVATE"       // RFC 1918, and IPv6 unique local
+	CATEGORY_CGNAT         = "CGNAT"         // shared address space, RFC 6598
+	CATEGORY_LOOPBACK      = "LOOPBACK"      // RFC 1122, RFC 4291
+	CATEGORY_LINK_LOCAL    = "LINK_LOCAL"    // RFC 3927, RFC 4291
+	CATEGORY_DOCUMENTATION = "DOCUMENTATION" // RFC 5737, RFC 3849, RFC 9637
+	CATEGORY_MULTICAST     = "MULTICAST"     // RFC 5771, RFC 4291
+	CATEGORY_BENCHMARKING  = "BENCHMARKING"  // RFC 2544, RFC 5180
+	CATEGORY_THIS_NETWORK  = "THIS_NETWORK"  // RFC 791, and the IPv6 unspecified address
+	CATEGORY_BROADCAST     = "BROADCAST"     // RFC 919
+	CATEGORY_PROTOCOL      = "PROTOCOL"      // IETF protocol assignments
+	CATEGORY_TRANSLATION   = "TRANSLATION"   // IPv4/IPv6 translation, RFC 6052, RFC 8215
+	CATEGORY_DISCARD       = "DISCARD"       // discard-only, RFC 6666
+	CATEGORY_RESERVED      = "RESERVED"      // reserved for future use, RFC 1112
+)
+
+// SpecialPurpose is a network of the special-purpose address registry.
+type SpecialPurpose struct {
+	Network  netip.Prefix
+	Category string
+}
+
+// SpecialPurposes is the registry; of the networks containing an address,
+// the longest prefix applies.  It is indexed by the first call of Special,
+// so it must not change after that.
+var SpecialPurposes = []SpecialPurpose{
+	{netip.MustParsePrefix("0.0.0.0/8"), CATEGORY_THIS_NETWORK},
+	{netip.MustParsePrefix("10.0.0.0/8"), CATEGORY_PRIVATE},
+	{netip.MustParsePrefix("100.64.0.0/10"), CATEGORY_CGNAT},
+	{netip.MustParsePrefix("127.0.0.0/8"), CATEGORY_LOOPBACK},
+	{netip.MustParsePrefix("169.254.0.0/16"), CATEGORY_LINK_LOCAL},
+	{netip.MustParsePrefix("172.16.0.0/12"), CATEGORY_PRIVATE},
+	{netip.MustParsePrefix("192.0.0.0/24"), CATEGORY_PROTOCOL},
+	{netip.MustParsePrefix("192.0.2.0/24"), CATEGORY_DOCUMENTATION},
+	{netip.MustParsePrefix("192.88.99.0/24"), CATEGORY_RESERVED},
+	{netip.MustParsePrefix("192.168.0.0/16"), CATEGORY_PRIVATE},
+	{netip.MustParsePrefix("198.18.0.0/15"), CATEGORY_BENCHMARKING},
+	{netip.MustParsePrefix("198.51.100.0/24"), CATEGORY_DOCUMENTATION},
+	{netip.MustParsePrefix("203.0.113.0/24"), CATEGORY_DOCUMENTATION},
+	{netip.MustParsePrefix("224.0.0.0/4"), CATEGORY_MULTICAST},
+	{netip.MustParsePrefix("240.0.0.0/4"), CATEGORY_RESERVED},
+	{netip.MustParsePrefix("255.255.255.255/32"), CATEGORY_BROADCAST},
+
+	{netip.MustParsePrefix("::/128"), CATEGORY_THIS_NETWORK},
+	{netip.MustParsePrefix("::1/128"), CATEGORY_LOOPBACK},
+	{netip.MustParsePrefix("64:ff9b::/96"), CATEGORY_TRANSLATION},
+	{netip.MustParsePrefix("64:ff9b:1::/48"), CATEGORY_TRANSLATION},
+	{netip.MustParsePrefix("100::/64"), CATEGORY_DISCARD},
+	{netip.MustParsePrefix("2001::/23"), CATEGORY_PROTOCOL},
+	{netip.MustParsePrefix("2001:2::/48"), CATEGORY_BENCHMARKING},
+	{netip.MustParsePrefix("2001:db8::/32"), CATEGORY_DOCUMENTATION},
+	{netip.MustParsePrefix("3fff::/20"), CATEGORY_DOCUMENTATION},
+	{netip.MustParsePrefix("fc00::/7"), CATEGORY_PRIVATE},
+	{netip.MustParsePrefix("fe80::/10"), CATEGORY_LINK_LOCAL},
+	{netip.MustParsePrefix("ff00::/8"), CATEGORY_MULTICAST},
+}
+
+// specialIndex is the trie of SpecialPurposes, by their index.  It is not
+// compacted: the few IPv4 networks are found in a few steps anyway.
+var specialIndex = sync.OnceValue(func() *Trie {
+	t := NewTrie()
+	for i, s := range SpecialPurposes {
+		t.Insert(s.Network, int32(i))
+	}
+	return t
+})
+
+// Special returns the special-purpose network containing addr, if any.
+func Special(addr netip.Addr) (SpecialPurpose, bool) {
+	if !addr.IsValid() {
+		return SpecialPurpose{}, false
+	}
+	if i, ok := specialIndex().Lookup(addr); ok {
+		return SpecialPurposes[i], true
+	}
+	return SpecialPurpose{}, false
+}
+
+// IsCategory reports whether name is the category of a special-purpose
+// network.
+func IsCategory(name string) bool {
+	for _, s := range SpecialPurposes {
+		if s.Category == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Location returns the location of an address in the network, which has
+// no country or city.
+func (s SpecialPurpose) Location() Location {
+	loc := Location{Network: s.Network, Category: s.Category}
+	loc.First, loc.Last = prefixBounds(s.Network)
+	return loc
+}
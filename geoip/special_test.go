@@ -0,0 +1,92 @@
+package geoip
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestSpecial(t *testing.T) {
+	cases := []struct {
+		addr, category string
+	}{
+		{"10.1.2.3", CATEGORY_PRIVATE},
+		{"172.31.255.255", CATEGORY_PRIVATE},
+		{"172.32.0.1", ""},
+		{"100.127.0.1", CATEGORY_CGNAT},
+		{"127.0.0.1", CATEGORY_LOOPBACK},
+		{"::ffff:192.168.1.1", CATEGORY_PRIVATE},
+		{"203.0.113.9", CATEGORY_DOCUMENTATION},
+		{"239.1.1.1", CATEGORY_MULTICAST},
+		{"255.255.255.255", CATEGORY_BROADCAST},
+		{"255.255.255.254", CATEGORY_RESERVED},
+		{"8.8.8.8", ""},
+		{"::1", CATEGORY_LOOPBACK},
+		{"fd00::1", CATEGORY_PRIVATE},
+		{"2001:db8::1", CATEGORY_DOCUMENTATION},
+		{"2001:2::1", CATEGORY_BENCHMARKING},
+		{"2001:4860::8888", ""},
+	}
+	for _, c := range cases {
+		s, ok := Special(netip.MustParseAddr(c.addr))
+		if ok != (c.category != "") || s.Category != c.category {
+			t.Errorf("%v: expected %q, got %+v", c.addr, c.category, s)
+		}
+	}
+}
+
+// TestSpecial_Linear compares Special with the longest match of a scan of
+// the registry, around the bounds of every network.
+func TestSpecial_Linear(t *testing.T) {
+	linear := func(addr netip.Addr) string {
+		var found SpecialPurpose
+		for _, s := range SpecialPurposes {
+			if s.Network.Contains(addr.Unmap()) && (!found.Network.IsValid() || s.Network.Bits() > found.Network.Bits()) {
+				found = s
+			}
+		}
+		return found.Category
+	}
+	for _, s := range SpecialPurposes {
+		first, last := prefixBounds(s.Network)
+		for _, addr := range []netip.Addr{first, first.Prev(), first.Next(), last, last.Prev(), last.Next()} {
+			if !addr.IsValid() {
+				continue
+			}
+			if got, _ := Special(addr); got.Category != linear(addr) {
+				t.Errorf("%v: expected %q, got %q", addr, linear(addr), got.Category)
+			}
+		}
+	}
+	if s, ok := Special(netip.Addr{}); ok {
+		t.Errorf("invalid address: %+v", s)
+	}
+}
+
+func BenchmarkSpecial(b *testing.B) {
+	addrs := []netip.Addr{
+		netip.MustParseAddr("8.8.8.8"),
+		netip.MustParseAddr("192.168.1.1"),
+		netip.MustParseAddr("2001:4860::8888"),
+		netip.MustParseAddr("fe80::1"),
+	}
+	for i := 0; i < b.N; i++ {
+		Special(addrs[i%len(addrs)])
+	}
+}
+
+func TestOverlay_Special(t *testing.T) {
+	db := &Overlay{Database: openTestDatabase(t)}
+	loc, err := db.LookupString("192.168.1.1")
+	if err != nil || loc.Category != CATEGORY_PRIVATE || loc.Country != "" || loc.Network.String() != "192.168.0.0/16" {
+		t.Errorf("unexpected location: %+v, %v", loc, err)
+	}
+	if loc, err := db.LookupString("3.3.3.3"); err != nil || loc.Category != "" || loc.City != "Fairfield" {
+		t.Errorf("unexpected location: %+v, %v", loc, err)
+	}
+
+	db.Overrides = NewOverrides([]*Override{{Network: netip.MustParsePrefix("192.168.1.0/24"), Country: "US", City: "Corp"}})
+	loc, err = db.LookupString("192.168.1.1")
+	if err != nil || loc.Category != CATEGORY_PRIVATE || loc.City != "Corp" {
+		t.Errorf("override not applied: %+v, %v", loc, err)
+	}
+}
@@ -0,0 +1,268 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+	"unsafe"
+)
+
+// Trie is a compressed binary (Patricia) trie of IPv4 and IPv6 prefixes,
+// for the longest-prefix match of addresses.  The prefixes may be nested.
+// Each prefix has a value, e.g. the index of its entry in a database.
+// The nodes are kept in arrays, so the trie is compact and cheap for the
+// garbage collector.  A Trie is safe for concurrent lookups, but not for
+// lookups concurrent with Insert.
+type Trie struct {
+	v4 trie[key4]
+	v6 trie[key6]
+
+	// where the IPv4 lookups start, by the first TOP_BITS of the address
+	top []trieStart
+}
+
+// The IPv4 lookups skip the first TOP_BITS levels of the trie with a table
+// of 1<<TOP_BITS starting points, built by Compact.
+const TOP_BITS = 16
+
+type trieStart struct {
+	node int32 // the first node below TOP_BITS, or -1
+	best int32 // the value of the longest prefix above it, or -1
+}
+
+// NewTrie returns an empty trie.
+func NewTrie() *Trie {
+	return &Trie{v4: newTrie[key4](32), v6: newTrie[key6](128)}
+}
+
+// Insert adds the prefix p with value, which must not be negative.  The
+// value of a prefix that is already in the trie is replaced.  An
+// IPv4-mapped IPv6 prefix is inserted as IPv4.
+func (t *Trie) Insert(p netip.Prefix, value int32) {
+	t.top = nil
+	addr, nbits := p.Addr(), p.Bits()
+	if addr.Is4In6() && nbits >= 96 {
+		addr, nbits = addr.Unmap(), nbits-96
+	}
+	if addr.Is4() {
+		t.v4.insert(addrKey4(addr).masked(nbits), nbits, value)
+	} else {
+		t.v6.insert(addrKey6(addr).masked(nbits), nbits, value)
+	}
+}
+
+// InsertRange adds the range with value, as the smallest set of prefixes
+// covering it.
+func (t *Trie) InsertRange(r IP4Range, value int32) {
+	t.top = nil
+	begin, end := uint64(r.Begin), uint64(r.End)
+	for begin <= end {
+		// the largest block aligned at begin that does not pass end
+		size := uint64(1) << bits.TrailingZeros32(uint32(begin))
+		for begin+size-1 > end {
+			size >>= 1
+		}
+		t.v4.insert(key4(begin), 32-bits.TrailingZeros64(size), value)
+		begin += size
+	}
+}
+
+// Lookup returns the value of the longest prefix containing addr.
+func (t *Trie) Lookup(addr netip.Addr) (int32, bool) {
+	addr = addr.Unmap()
+	if !addr.Is4() {
+		return t.v6.lookup(addrKey6(addr), t.v6.root, -1)
+	}
+	key := addrKey4(addr)
+	if t.top != nil {
+		start := t.top[key>>(32-TOP_BITS)]
+		return t.v4.lookup(key, start.node, start.best)
+	}
+	return t.v4.lookup(key, t.v4.root, -1)
+}
+
+// Compact speeds up the IPv4 lookups after the prefixes are inserted.
+// Inserting more prefixes undoes it.
+func (t *Trie) Compact() {
+	t.v4.nodes = append([]trieNode[key4](nil), t.v4.nodes...)
+	top := make([]trieStart, 1<<TOP_BITS)
+	for i := range top {
+		key := key4(i << (32 - TOP_BITS))
+		start := trieStart{node: t.v4.root, best: -1}
+		for start.node >= 0 {
+			node := &t.v4.nodes[start.node]
+			if node.bits >= TOP_BITS {
+				// the rest depends on the bits after TOP_BITS
+				break
+			}
+			if key.masked(int(node.bits)) != node.key {
+				start.node = -1
+				break
+			}
+			if node.value >= 0 {
+				start.best = node.value
+			}
+			start.node = node.child[key.bit(int(node.bits))]
+		}
+		top[i] = start
+	}
+	t.top = top
+}
+
+// Len returns the number of prefixes in the trie.
+func (t *Trie) Len() int {
+	return t.v4.count + t.v6.count
+}
+
+// MemoryBytes returns the memory used by the nodes of the trie.
+func (t *Trie) MemoryBytes() int64 {
+	return t.v4.memoryBytes() + t.v6.memoryBytes() + int64(cap(t.top))*int64(unsafe.Sizeof(trieStart{}))
+}
+
+// trieKey is an address of a trie, compared from its most significant bit.
+type trieKey[K any] interface {
+	comparable
+	bit(i int) int  // the i-th bit, 0 or 1
+	masked(n int) K // the key with only the first n bits
+	common(o K) int // the number of leading bits equal to o
+}
+
+type key4 uint32
+
+func addrKey4(addr netip.Addr) key4 {
+	a := addr.As4()
+	return key4(binary.BigEndian.Uint32(a[:]))
+}
+
+func (k key4) bit(i int) int     { return int(k>>(31-i)) & 1 }
+func (k key4) masked(n int) key4 { return k & (^key4(0) << (32 - n)) }
+func (k key4) common(o key4) int { return bits.LeadingZeros32(uint32(k ^ o)) }
+
+type key6 struct{ hi, lo uint64 }
+
+func addrKey6(addr netip.Addr) key6 {
+	a := addr.As16()
+	return key6{binary.BigEndian.Uint64(a[:8]), binary.BigEndian.Uint64(a[8:])}
+}
+
+func (k key6) bit(i int) int {
+	if i < 64 {
+		return int(k.hi>>(63-i)) & 1
+	}
+	return int(k.lo>>(127-i)) & 1
+}
+
+func (k key6) masked(n int) key6 {
+	if n <= 64 {
+		return key6{k.hi & (^uint64(0) << (64 - n)), 0}
+	}
+	return key6{k.hi, k.lo & (^uint64(0) << (128 - n))}
+}
+
+func (k key6) common(o key6) int {
+	if k.hi != o.hi {
+		return bits.LeadingZeros64(k.hi ^ o.hi)
+	}
+	return 64 + bits.LeadingZeros64(k.lo^o.lo)
+}
+
+// trieNode is a prefix of the trie.  The nodes that only join two
+// subtrees have no value (-1).  A child of -1 is none.
+type trieNode[K trieKey[K]] struct {
+	key   K
+	bits  uint8
+	value int32
+	child [2]int32
+}
+
+type trie[K trieKey[K]] struct {
+	nodes   []trieNode[K]
+	root    int32
+	maxBits int
+	count   int
+}
+
+func newTrie[K trieKey[K]](maxBits int) trie[K] {
+	return trie[K]{root: -1, maxBits: maxBits}
+}
+
+func (t *trie[K]) newNode(key K, nbits int, value int32) int32 {
+	t.nodes = append(t.nodes, trieNode[K]{key: key, bits: uint8(nbits), value: value, child: [2]int32{-1, -1}})
+	if value >= 0 {
+		t.count++
+	}
+	return int32(len(t.nodes) - 1)
+}
+
+// insert adds the masked key of nbits.  The link to the current node is
+// given by its parent and side, as the nodes move when the array grows.
+func (t *trie[K]) insert(key K, nbits int, value int32) {
+	parent, side := int32(-1), 0
+	link := func() *int32 {
+		if parent < 0 {
+			return &t.root
+		}
+		return &t.nodes[parent].child[side]
+	}
+
+	for {
+		n := *link()
+		if n < 0 {
+			leaf := t.newNode(key, nbits, value)
+			*link() = leaf
+			return
+		}
+		node := t.nodes[n]
+		c := min(key.common(node.key), nbits, int(node.bits))
+		switch {
+		case c == int(node.bits) && c == nbits:
+			// the same prefix
+			if node.value < 0 {
+				t.count++
+			}
+			t.nodes[n].value = value
+			return
+		case c == int(node.bits):
+			// the node contains the key; go down
+			parent, side = n, key.bit(c)
+		case c == nbits:
+			// the key contains the node
+			m := t.newNode(key, nbits, value)
+			t.nodes[m].child[node.key.bit(c)] = n
+			*link() = m
+			return
+		default:
+			// they diverge at bit c
+			join := t.newNode(key.masked(c), c, -1)
+			leaf := t.newNode(key, nbits, value)
+			t.nodes[join].child[key.bit(c)] = leaf
+			t.nodes[join].child[node.key.bit(c)] = n
+			*link() = join
+			return
+		}
+	}
+}
+
+// lookup returns the value of the longest prefix containing key, from
+// the node n down; best is the value of the longest prefix above n.
+func (t *trie[K]) lookup(key K, n int32, best int32) (int32, bool) {
+	for n >= 0 {
+		node := &t.nodes[n]
+		if key.masked(int(node.bits)) != node.key {
+			break
+		}
+		if node.value >= 0 {
+			best = node.value
+		}
+		if int(node.bits) == t.maxBits {
+			break
+		}
+		n = node.child[key.bit(int(node.bits))]
+	}
+	return best, best >= 0
+}
+
+func (t *trie[K]) memoryBytes() int64 {
+	var node trieNode[K]
+	return int64(cap(t.nodes)) * int64(unsafe.Sizeof(node))
+}
@@ -0,0 +1,165 @@
+package geoip
+
+import (
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+func TestTrie(t *testing.T) {
+	trie := NewTrie()
+	for i, p := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32", "0.0.0.0/0", "2001:db8::/32", "2001:db8:1::/48", "::ffff:192.168.0.0/112"} {
+		trie.Insert(netip.MustParsePrefix(p), int32(i))
+	}
+	trie.Insert(netip.MustParsePrefix("10.1.0.0/16"), 10) // replaced
+	if trie.Len() != 8 {
+		t.Errorf("unexpected length: %v", trie.Len())
+	}
+
+	cases := []struct {
+		addr  string
+		value int32
+	}{
+		{"10.1.2.3", 3},
+		{"10.1.2.4", 2},
+		{"10.1.3.1", 10},
+		{"10.2.0.1", 0},
+		{"11.0.0.1", 4},
+		{"::ffff:10.1.2.3", 3},
+		{"192.168.1.1", 7},
+		{"2001:db8:1::1", 6},
+		{"2001:db8:2::1", 5},
+		{"2001:db9::1", -1},
+	}
+	for _, c := range cases {
+		v, ok := trie.Lookup(netip.MustParseAddr(c.addr))
+		if ok != (c.value >= 0) || (ok && v != c.value) {
+			t.Errorf("%v: expected %v, got %v %v", c.addr, c.value, v, ok)
+		}
+	}
+}
+
+func TestTrie_InsertRange(t *testing.T) {
+	trie := NewTrie()
+	// 1.0.0.1-1.0.1.0 is 1.0.0.1/32, /31, /30, ... 1.0.0.128/25, 1.0.1.0/32
+	trie.InsertRange(IP4Range{Begin: 0x01000001, End: 0x01000100}, 1)
+	if trie.Len() != 9 {
+		t.Errorf("unexpected number of prefixes: %v", trie.Len())
+	}
+	for addr, found := range map[string]bool{"1.0.0.0": false, "1.0.0.1": true, "1.0.0.200": true, "1.0.1.0": true, "1.0.1.1": false} {
+		if _, ok := trie.Lookup(netip.MustParseAddr(addr)); ok != found {
+			t.Errorf("%v: expected %v", addr, found)
+		}
+	}
+
+	trie = NewTrie()
+	trie.InsertRange(IP4Range{Begin: 0, End: 0xffffffff}, 1)
+	if _, ok := trie.Lookup(netip.MustParseAddr("255.255.255.255")); !ok || trie.Len() != 1 {
+		t.Errorf("whole address space not found")
+	}
+}
+
+// newRandomBlockDatabase returns n blocks of random sizes with random gaps
+// between them.
+func newRandomBlockDatabase(n int) *BlockDatabase {
+	r := rand.New(rand.NewSource(1))
+	var entries []BlockEntry
+	begin := uint32(0x01000000)
+	for i := 0; i < n; i++ {
+		bits := 20 + r.Intn(13)
+		size := uint32(1) << (32 - bits)
+		begin = (begin + size - 1) &^ (size - 1)
+		if r.Intn(4) == 0 {
+			begin += size
+		}
+		entries = append(entries, BlockEntry{IP4Range: IP4Range{Begin: begin, End: begin + size - 1}, GeoID: i})
+		begin += size
+	}
+	return NewBlockDatabase(entries)
+}
+
+func TestBlockDatabase_Index(t *testing.T) {
+	db := newRandomBlockDatabase(10000)
+	db.index = nil
+	indexed := newRandomBlockDatabase(10000)
+	r := rand.New(rand.NewSource(2))
+	last := db.end[db.Len()-1]
+	for i := 0; i < 100000; i++ {
+		addr := uint32ToAddr(0x01000000 + uint32(r.Int63n(int64(last-0x01000000)+2)))
+		e1, err1 := db.SearchAddr(addr)
+		e2, err2 := indexed.SearchAddr(addr)
+		if (err1 == nil) != (err2 == nil) || e1.GeoID != e2.GeoID {
+			t.Fatalf("%v: binary search %v %v, trie %v %v", addr, e1.GeoID, err1, e2.GeoID, err2)
+		}
+	}
+}
+
+// The lookups of the trie against the binary search, over 2.7M blocks as
+// many as GeoLite2 City.  The memory of the index is reported per block.
+func benchmarkLookup(b *testing.B, index bool) {
+	db := newRandomBlockDatabase(2700000)
+	if !index {
+		db.index = nil
+	}
+	r := rand.New(rand.NewSource(2))
+	last := db.end[db.Len()-1]
+	addrs := make([]netip.Addr, 4096)
+	for i := range addrs {
+		addrs[i] = uint32ToAddr(0x01000000 + uint32(r.Int63n(int64(last-0x01000000))))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.SearchAddr(addrs[i%len(addrs)])
+	}
+	if index {
+		b.ReportMetric(float64(db.index.MemoryBytes())/float64(db.Len()), "index-bytes/block")
+	}
+}
+
+func BenchmarkLookup_BinarySearch(b *testing.B) {
+	benchmarkLookup(b, false)
+}
+
+func BenchmarkLookup_Trie(b *testing.B) {
+	benchmarkLookup(b, true)
+}
+
+func TestTrie_Compact(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	trie := NewTrie()
+	var prefixes []netip.Prefix
+	for i := 0; i < 2000; i++ {
+		p, _ := uint32ToAddr(r.Uint32()).Prefix(r.Intn(33))
+		prefixes = append(prefixes, p)
+		trie.Insert(p, int32(i))
+	}
+	// the longest prefix by a linear search; a later one replaces the same
+	expect := func(addr netip.Addr) int32 {
+		best, bits := int32(-1), -1
+		for i, p := range prefixes {
+			if p.Contains(addr) && p.Bits() >= bits {
+				best, bits = int32(i), p.Bits()
+			}
+		}
+		return best
+	}
+	addrs := make([]netip.Addr, 2000)
+	for i := range addrs {
+		if i%2 == 0 {
+			addrs[i] = uint32ToAddr(r.Uint32())
+		} else {
+			addrs[i] = prefixes[r.Intn(len(prefixes))].Addr()
+		}
+	}
+	for _, compact := range []bool{false, true} {
+		if compact {
+			trie.Compact()
+		}
+		for _, addr := range addrs {
+			v, ok := trie.Lookup(addr)
+			if e := expect(addr); v != e || ok != (e >= 0) {
+				t.Fatalf("compact=%v: %v: expected %v, got %v", compact, addr, e, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package geoip
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Severities of the problems found by ValidateRelease.  With an error, the
+// database is loaded otherwise than its files describe; a warning is about
+// what the loader handles, e.g. by ignoring the line.
+const (
+	SEVERITY_ERROR   = "error"
+	SEVERITY_WARNING = "warning"
+)
+
+// Kinds of the problems found by ValidateRelease.
+const (
+	PROBLEM_SYNTAX      = "syntax"      // a malformed CSV line
+	PROBLEM_ENCODING    = "encoding"    // invalid UTF-8, a NUL or a byte order mark
+	PROBLEM_CIDR        = "cidr"        // a malformed or non-IPv4 network
+	PROBLEM_GEONAME_ID  = "geoname_id"  // a missing, malformed or duplicate geoname ID
+	PROBLEM_DANGLING    = "dangling"    // a geoname ID not in the city file
+	PROBLEM_COORDINATES = "coordinates" // missing or invalid coordinates
+	PROBLEM_UNSORTED    = "unsorted"    // a network before the one of the previous line
+	PROBLEM_OVERLAP     = "overlap"     // a network overlapping another one
+)
+
+// MAX_PROBLEMS is the number of the problems of a kind listed in a
+// ValidationReport; the others are only counted.
+const MAX_PROBLEMS = 100
+
+// Problem is a problem of a line of a database file.
+type Problem struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Severity string `json:"severity"`
+	Kind     string `json:"kind"`
+	Message  string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%v:%v: %v: %v: %v", p.File, p.Line, p.Severity, p.Kind, p.Message)
+}
+
+// ValidationReport is the result of ValidateRelease.
+type ValidationReport struct {
+	Directory string         `json:"directory"`
+	Cities    int            `json:"cities"` // lines checked
+	Blocks    int            `json:"blocks"` // lines checked
+	Errors    int            `json:"errors"`
+	Warnings  int            `json:"warnings"`
+	Counts    map[string]int `json:"counts"` // problems by kind
+	// up to MAX_PROBLEMS of each kind, by file and line
+	Problems []Problem `json:"problems"`
+}
+
+func (r *ValidationReport) add(file string, line int, severity, kind, format string, args ...any) {
+	if severity == SEVERITY_ERROR {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+	r.Counts[kind]++
+	if r.Counts[kind] <= MAX_PROBLEMS {
+		r.Problems = append(r.Problems, Problem{file, line, severity, kind, fmt.Sprintf(format, args...)})
+	}
+}
+
+// OK reports whether no error was found.
+func (r *ValidationReport) OK() bool {
+	return r.Errors == 0
+}
+
+// ValidateRelease checks the CSV files of a GeoLite2 City release in dir,
+// named as in opts, for the lines the loader would ignore or load wrongly.
+// The error is only of reading the files.
+func ValidateRelease(dir string, opts Options) (*ValidationReport, error) {
+	if opts.BlockFile == "" {
+		opts.BlockFile = BLOCK_CSV_FILE
+	}
+	if opts.CityFile == "" {
+		opts.CityFile = CITY_CSV_FILE
+	}
+	r := &ValidationReport{Directory: dir, Counts: map[string]int{}, Problems: []Problem{}}
+	cityFile := filepath.Join(dir, opts.CityFile)
+	cities, err := r.checkCities(cityFile)
+	if err != nil {
+		return nil, err
+	}
+	blockFile := filepath.Join(dir, opts.BlockFile)
+	if err := r.checkBlocks(blockFile, cities); err != nil {
+		return nil, err
+	}
+
+	order := map[string]int{cityFile: 0, blockFile: 1}
+	sort.SliceStable(r.Problems, func(i, j int) bool {
+		pi, pj := r.Problems[i], r.Problems[j]
+		if pi.File != pj.File {
+			return order[pi.File] < order[pj.File]
+		}
+		return pi.Line < pj.Line
+	})
+	return r, nil
+}
+
+// csvLines calls fn with every record of filename after the header, and
+// its line number, and counts them in lines; the lines that are not CSV,
+// have another number of fields than the header, or are not UTF-8 are
+// reported instead.
+func (r *ValidationReport) csvLines(filename string, lines *int, fn func(record []string, line int)) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	if bom, _ := br.Peek(3); string(bom) == "\xef\xbb\xbf" {
+		r.add(filename, 1, SEVERITY_WARNING, PROBLEM_ENCODING, "byte order mark")
+		br.Discard(3)
+	}
+	reader := csv.NewReader(br)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		r.add(filename, 1, SEVERITY_ERROR, PROBLEM_SYNTAX, "empty file")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	header = slices.Clone(header)
+	fields := len(header)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		*lines++
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			r.add(filename, perr.Line, SEVERITY_ERROR, PROBLEM_SYNTAX, "%v", perr.Err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) != fields {
+			r.add(filename, line, SEVERITY_ERROR, PROBLEM_SYNTAX, "%v fields, expected %v", len(record), fields)
+			continue
+		}
+		bad := false
+		for i, field := range record {
+			switch {
+			case !utf8.ValidString(field):
+				r.add(filename, line, SEVERITY_ERROR, PROBLEM_ENCODING, "invalid UTF-8 in %v", header[i])
+				bad = true
+			case strings.IndexByte(field, 0) >= 0:
+				r.add(filename, line, SEVERITY_ERROR, PROBLEM_ENCODING, "NUL in %v", header[i])
+				bad = true
+			}
+		}
+		if !bad {
+			fn(record, line)
+		}
+	}
+}
+
+// checkCities returns the geoname IDs of the city file.
+func (r *ValidationReport) checkCities(filename string) (map[int]bool, error) {
+	lines := map[int]int{} // of the geoname IDs
+	err := r.csvLines(filename, &r.Cities, func(record []string, line int) {
+		if len(record) < 11 {
+			r.add(filename, line, SEVERITY_ERROR, PROBLEM_SYNTAX, "%v fields, expected at least 11", len(record))
+			return
+		}
+		id, err := strconv.ParseUint(record[0], 10, 31)
+		if err != nil {
+			r.add(filename, line, SEVERITY_ERROR, PROBLEM_GEONAME_ID, "malformed geoname_id %q", record[0])
+			return
+		}
+		if prev, ok := lines[int(id)]; ok {
+			r.add(filename, line, SEVERITY_ERROR, PROBLEM_GEONAME_ID, "geoname_id %v of line %v again", id, prev)
+			return
+		}
+		lines[int(id)] = line
+	})
+	cities := make(map[int]bool, len(lines))
+	for id := range lines {
+		cities[id] = true
+	}
+	return cities, err
+}
+
+func (r *ValidationReport) checkBlocks(filename string, cities map[int]bool) error {
+	type block struct {
+		IP4Range
+		line int
+	}
+	var blocks []block
+	sorted := true
+	err := r.csvLines(filename, &r.Blocks, func(record []string, line int) {
+		if len(record) < 9 {
+			r.add(filename, line, SEVERITY_ERROR, PROBLEM_SYNTAX, "%v fields, expected at least 9", len(record))
+			return
+		}
+
+		p, err := netip.ParsePrefix(record[0])
+		ip4, err4 := NewIP4Range(record[0])
+		switch {
+		case err != nil:
+			r.add(filename, line, SEVERITY_ERROR, PROBLEM_CIDR, "malformed network %q", record[0])
+		case err4 != nil:
+			r.add(filename, line, SEVERITY_ERROR, PROBLEM_CIDR, "%v is not an IPv4 network", p)
+		default:
+			if p != p.Masked() {
+				r.add(filename, line, SEVERITY_WARNING, PROBLEM_CIDR, "%v has host bits set, loaded as %v", p, p.Masked())
+			}
+			if n := len(blocks); n > 0 && sorted && ip4.Begin < blocks[n-1].Begin {
+				r.add(filename, line, SEVERITY_WARNING, PROBLEM_UNSORTED,
+					"%v before the network of line %v; the blocks are not in address order", p, blocks[n-1].line)
+				sorted = false
+			}
+			blocks = append(blocks, block{ip4, line})
+		}
+
+		if record[1] == "" {
+			r.add(filename, line, SEVERITY_WARNING, PROBLEM_GEONAME_ID, "no geoname_id; the block is not loaded")
+		}
+		for i, name := range []string{"geoname_id", "registered_country_geoname_id", "represented_country_geoname_id"} {
+			if record[1+i] == "" {
+				continue
+			}
+			id, err := strconv.ParseUint(record[1+i], 10, 31)
+			if err != nil {
+				r.add(filename, line, SEVERITY_ERROR, PROBLEM_GEONAME_ID, "malformed %v %q", name, record[1+i])
+			} else if !cities[int(id)] {
+				// only the location of geoname_id is loaded
+				severity := SEVERITY_WARNING
+				if i == 0 {
+					severity = SEVERITY_ERROR
+				}
+				r.add(filename, line, severity, PROBLEM_DANGLING, "%v %v is not in the city file", name, id)
+			}
+		}
+
+		if record[7] == "" || record[8] == "" {
+			r.add(filename, line, SEVERITY_WARNING, PROBLEM_COORDINATES, "no coordinates; the block is not loaded")
+			return
+		}
+		lat, err1 := strconv.ParseFloat(record[7], 32)
+		lng, err2 := strconv.ParseFloat(record[8], 32)
+		switch {
+		case err1 != nil || err2 != nil:
+			r.add(filename, line, SEVERITY_ERROR, PROBLEM_COORDINATES, "malformed coordinates %q, %q", record[7], record[8])
+		case lat < -90 || lat > 90 || lng < -180 || lng > 180:
+			r.add(filename, line, SEVERITY_ERROR, PROBLEM_COORDINATES, "coordinates %v, %v out of range", lat, lng)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// each block is compared with the block of the latest end before it
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].Begin < blocks[j].Begin })
+	for i := 1; i < len(blocks); i++ {
+		prev := blocks[i-1]
+		if blocks[i].Begin <= prev.End {
+			r.add(filename, blocks[i].line, SEVERITY_ERROR, PROBLEM_OVERLAP,
+				"%v overlaps %v of line %v", blocks[i].IP4Range.Prefix(), prev.IP4Range.Prefix(), prev.line)
+		}
+		if blocks[i].End < prev.End {
+			blocks[i] = prev
+		}
+	}
+	return nil
+}
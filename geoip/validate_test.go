@@ -0,0 +1,63 @@
+package geoip
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateRelease(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, CITY_CSV_FILE), []byte(testCityCSV+"5097315,en,NA,,US,,,,,,Again,,\n"), 0644)
+	os.WriteFile(filepath.Join(dir, BLOCK_CSV_FILE), []byte(testBlockCSV+
+		"3.3.3.128/25,5097315,,,0,0,,40.8838,-74.3060,10\n"+ // line 4
+		"1.2.3.0/33,5097315,,,0,0,,1,1,1\n"+
+		"1.2.4.1/24,42,,,0,0,,1,1,1\n"+
+		"1.2.5.0/24,,6252001,,0,0,,,,1\n"+
+		"1.2.6.0/24,5097315,,,0,0,,91,1,1\n"+
+		"1.2.7.0/24,5097315,,,0,0,\xff,1,1,1\n"+ // line 9
+		"1.2.8.0/24,5097315\n"), 0644)
+
+	r, err := ValidateRelease(dir, Options{})
+	if err != nil {
+		t.Fatalf("cannot validate: %v", err)
+	}
+	expected := []struct {
+		line     int
+		severity string
+		kind     string
+	}{
+		{4, SEVERITY_ERROR, PROBLEM_GEONAME_ID}, // of the city file
+		{2, SEVERITY_WARNING, PROBLEM_DANGLING},
+		{3, SEVERITY_WARNING, PROBLEM_DANGLING},
+		{4, SEVERITY_WARNING, PROBLEM_UNSORTED},
+		{4, SEVERITY_ERROR, PROBLEM_OVERLAP},
+		{5, SEVERITY_ERROR, PROBLEM_CIDR},
+		{6, SEVERITY_WARNING, PROBLEM_CIDR},
+		{6, SEVERITY_ERROR, PROBLEM_DANGLING},
+		{7, SEVERITY_WARNING, PROBLEM_GEONAME_ID},
+		{7, SEVERITY_WARNING, PROBLEM_DANGLING},
+		{7, SEVERITY_WARNING, PROBLEM_COORDINATES},
+		{8, SEVERITY_ERROR, PROBLEM_COORDINATES},
+		{9, SEVERITY_ERROR, PROBLEM_ENCODING},
+		{10, SEVERITY_ERROR, PROBLEM_SYNTAX},
+	}
+	if len(r.Problems) != len(expected) || r.OK() {
+		t.Fatalf("unexpected problems: %v", r.Problems)
+	}
+	for i, e := range expected {
+		p := r.Problems[i]
+		if p.Line != e.line || p.Severity != e.severity || p.Kind != e.kind {
+			t.Errorf("problem %v: %v, expected line %v %v %v", i, p, e.line, e.severity, e.kind)
+		}
+	}
+	if r.Cities != 3 || r.Blocks != 9 || r.Errors != 7 || r.Warnings != 7 {
+		t.Errorf("unexpected report: %+v", r)
+	}
+
+	os.WriteFile(filepath.Join(dir, CITY_CSV_FILE), []byte(testCityCSV), 0644)
+	os.WriteFile(filepath.Join(dir, BLOCK_CSV_FILE), []byte(testBlockCSV), 0644)
+	if r, err := ValidateRelease(dir, Options{}); err != nil || !r.OK() {
+		t.Errorf("valid release: %v, %v", r.Problems, err)
+	}
+}
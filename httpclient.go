@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DEFAULT_HTTP_TIMEOUT = 30 * time.Second
+const DEFAULT_RETRIES = 3
+
+// Bounds of the delay between retries; a longer Retry-After is not
+// waited for.
+const MIN_RETRY_DELAY = time.Second
+const MAX_RETRY_DELAY = time.Minute
+
+// NewHTTPClient returns a client for the database downloads.  timeout
+// bounds connecting, the TLS handshake and waiting for the response
+// header, but not the whole download, which may take long on a slow link
+// (see Downloader.StallTimeout).  proxy overrides the proxy given by the
+// environment (HTTPS_PROXY, HTTP_PROXY and NO_PROXY).
+func NewHTTPClient(timeout time.Duration, proxy string) (*http.Client, error) {
+	if timeout <= 0 {
+		timeout = DEFAULT_HTTP_TIMEOUT
+	}
+	proxyFunc := http.ProxyFromEnvironment
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy url: %v", proxy)
+		}
+		proxyFunc = http.ProxyURL(u)
+	}
+	transport := &http.Transport{
+		Proxy:                 proxyFunc,
+		DialContext:           (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// retryableError is a failure that may succeed later, e.g. a network
+// error or a 503 status.
+type retryableError struct {
+	err   error
+	after time.Duration // Retry-After of the response, if any
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// retryAfter parses the Retry-After header, in seconds or an HTTP date.
+func retryAfter(resp *http.Response) time.Duration {
+	s := resp.Header.Get("Retry-After")
+	if s == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// retryable wraps the error of a non 2xx response if it is worth
+// retrying: server errors, and 429 with a short enough Retry-After.
+func retryable(resp *http.Response, err error) error {
+	after := retryAfter(resp)
+	switch {
+	case resp.StatusCode >= 500:
+	case resp.StatusCode == http.StatusTooManyRequests && after > 0 && after <= MAX_RETRY_DELAY:
+	default:
+		return err
+	}
+	return &retryableError{err: err, after: after}
+}
+
+// backoff returns the delay before the retry after the given number of
+// failed attempts: exponential from base with jitter, or the Retry-After.
+func backoff(attempt int, err error, base time.Duration) time.Duration {
+	if re, ok := err.(*retryableError); ok && re.after > 0 {
+		return re.after
+	}
+	if base <= 0 {
+		base = MIN_RETRY_DELAY
+	}
+	delay := base << uint(attempt)
+	if delay > MAX_RETRY_DELAY || delay <= 0 {
+		delay = MAX_RETRY_DELAY
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// stallReader cancels the request when no data was read within timeout,
+// so a stuck transfer fails (and can be resumed) instead of hanging.
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+	lock    sync.Mutex
+	stalled bool
+}
+
+func newStallReader(r io.Reader, timeout time.Duration, cancel context.CancelFunc) *stallReader {
+	s := &stallReader{r: r, timeout: timeout}
+	s.timer = time.AfterFunc(timeout, func() {
+		s.lock.Lock()
+		s.stalled = true
+		s.lock.Unlock()
+		cancel()
+	})
+	return s
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(s.timeout)
+	}
+	if err != nil && err != io.EOF {
+		s.lock.Lock()
+		if s.stalled {
+			err = fmt.Errorf("no data received for %v", s.timeout)
+		}
+		s.lock.Unlock()
+	}
+	return n, err
+}
+
+func (s *stallReader) Stop() {
+	s.timer.Stop()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newFlakyServer serves content, failing the first requests as given by
+// fail, which returns true if the request was handled.
+func newFlakyServer(content []byte, fail func(n int, w http.ResponseWriter, r *http.Request) bool) (*httptest.Server, *[]http.Header) {
+	var lock sync.Mutex
+	var requests []http.Header
+	modified := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, r.Header.Clone())
+		n := len(requests)
+		lock.Unlock()
+		if fail(n, w, r) {
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "db.zip", modified, bytes.NewReader(content))
+	}))
+	return server, &requests
+}
+
+func TestDownloader_RetryAndResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	server, requests := newFlakyServer(content, func(n int, w http.ResponseWriter, r *http.Request) bool {
+		switch n {
+		case 1:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return true
+		case 2:
+			// send the first half, then drop the connection
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", "100000")
+			w.Write(content[:50000])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return true
+		}
+		return false
+	})
+	defer server.Close()
+
+	var progress bytes.Buffer
+	d := Downloader{WorkDir: t.TempDir(), Retries: 3, RetryDelay: time.Millisecond, Progress: &progress}
+	defer d.Close()
+	if err := d.Fetch(server.URL + "/db.zip"); err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+
+	b, _ := os.ReadFile(d.Archive)
+	if !bytes.Equal(b, content) {
+		t.Errorf("downloaded %v bytes, expected the %v bytes of content", len(b), len(content))
+	}
+	if len(*requests) != 3 {
+		t.Fatalf("expected 3 requests, got %v", len(*requests))
+	}
+	if r := (*requests)[2]; r.Get("Range") != "bytes=50000-" || r.Get("If-Range") != `"v1"` {
+		t.Errorf("download not resumed: Range=%q If-Range=%q", r.Get("Range"), r.Get("If-Range"))
+	}
+	if !strings.Contains(progress.String(), "db.zip: 97.7KB / 97.7KB") {
+		t.Errorf("unexpected progress: %q", progress.String())
+	}
+	if d.ETag != `"v1"` {
+		t.Errorf("unexpected ETag: %v", d.ETag)
+	}
+}
+
+func TestDownloader_RetryLimit(t *testing.T) {
+	server, requests := newFlakyServer(nil, func(n int, w http.ResponseWriter, r *http.Request) bool {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return true
+	})
+	defer server.Close()
+
+	d := Downloader{WorkDir: t.TempDir(), Retries: 2, RetryDelay: time.Millisecond}
+	defer d.Close()
+	if err := d.Fetch(server.URL + "/db.zip"); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected the 503 status, got %v", err)
+	}
+	if len(*requests) != 3 {
+		t.Errorf("expected 3 requests, got %v", len(*requests))
+	}
+	if entries, _ := os.ReadDir(d.WorkDir); len(entries) != 0 {
+		t.Errorf("partial file left: %v", entries)
+	}
+}
+
+func TestDownloader_StallTimeout(t *testing.T) {
+	server, _ := newFlakyServer([]byte("content"), func(n int, w http.ResponseWriter, r *http.Request) bool {
+		if n == 1 {
+			w.Header().Set("Content-Length", "7")
+			w.Write([]byte("con"))
+			w.(http.Flusher).Flush()
+			time.Sleep(500 * time.Millisecond)
+			return true
+		}
+		return false
+	})
+	defer server.Close()
+
+	d := Downloader{WorkDir: t.TempDir(), Retries: 1, RetryDelay: time.Millisecond, StallTimeout: 50 * time.Millisecond}
+	defer d.Close()
+	if err := d.Fetch(server.URL + "/db.zip"); err != nil {
+		t.Fatalf("stalled transfer not retried: %v", err)
+	}
+	if b, _ := os.ReadFile(d.Archive); string(b) != "content" {
+		t.Errorf("unexpected content: %q", b)
+	}
+}
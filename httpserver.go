@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+// MAX_BATCH_LOOKUP is the maximum number of addresses in one POST /lookup,
+// and MAX_BATCH_BODY the maximum size of its body.
+const MAX_BATCH_LOOKUP = 10000
+const MAX_BATCH_BODY = 1 << 20
+
+// Timeouts of reading the HTTP requests, against the clients holding the
+// connections open.
+const HTTP_READ_HEADER_TIMEOUT = 10 * time.Second
+const HTTP_READ_TIMEOUT = time.Minute
+const HTTP_IDLE_TIMEOUT = 2 * time.Minute
+
+// LookupResult is the JSON representation of a lookup through the HTTP
+// interface.
+type LookupResult struct {
+	Address   string   `json:"address"`
+	Range     string   `json:"range,omitempty"`
+	GeoID     int      `json:"geoname_id,omitempty"`
+	Country   string   `json:"country,omitempty"`
+	City      string   `json:"city,omitempty"`
+	Latitude  float32  `json:"latitude"`
+	Longitude float32  `json:"longitude"`
+	Source    string   `json:"source,omitempty"`
+	Labels    []string `json:"labels,omitempty"`
+	Category  string   `json:"category,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type StatisticResult struct {
+	Entries []StatisticEntry `json:"entries"`
+}
+
+type StatisticEntry struct {
+	Name      string  `json:"name"`
+	Count     int     `json:"pop"`
+	Latitude  float32 `json:"lat"`
+	Longitude float32 `json:"lon"`
+	Group     int     `json:"group"`
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+// AddHTTPListener serves the HTTP/JSON interface on laddr:
+//
+//	GET  /lookup/{ip}  location of one address
+//	POST /lookup       locations of a JSON array of addresses
+//	GET  /stats        statistics; limit, groups, iteration, window and
+//	                   format (json, csv or text) as query parameters
+//	POST /reset        clear the statistics
+//	GET  /info         description of the current database
+//	POST /reload       reload the database, from the directory in the
+//	                   dir query parameter if given and ReloadDirs is set
+//	POST /overrides    reload the override file only
+//	GET  /status       state of the automatic database updates
+func (s *Server) AddHTTPListener(laddr string) error {
+	log.Printf("Listening on HTTP %v", laddr)
+	ln, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return err
+	}
+
+	hs := &http.Server{
+		Handler:           s.httpHandler(),
+		ReadHeaderTimeout: HTTP_READ_HEADER_TIMEOUT,
+		ReadTimeout:       HTTP_READ_TIMEOUT,
+		IdleTimeout:       HTTP_IDLE_TIMEOUT,
+	}
+	s.httpServers = append(s.httpServers, hs)
+	s.listenerGroup.Add(1)
+
+	go func() {
+		defer s.listenerGroup.Done()
+		if err := hs.Serve(ln); err != nil && err != http.ErrServerClosed {
+			Err(0, err, "http server failed")
+		}
+	}()
+	return nil
+}
+
+// httpHandler returns the handler of the HTTP/JSON interface.
+func (s *Server) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /lookup/{ip}", s.handleLookup)
+	mux.HandleFunc("POST /lookup", s.handleBatchLookup)
+	mux.HandleFunc("GET /stats", s.handleStats)
+	mux.HandleFunc("POST /reset", s.handleReset)
+	mux.HandleFunc("GET /info", s.handleInfo)
+	mux.HandleFunc("POST /reload", s.handleReload)
+	mux.HandleFunc("POST /overrides", s.handleReloadOverrides)
+	mux.HandleFunc("GET /status", s.handleStatus)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, httpError{Error: fmt.Sprintf(format, args...)})
+}
+
+// lookup resolves one address.  It returns the HTTP status of the result
+// along with the result.
+func (s *Server) lookup(addr string) (int, LookupResult) {
+	r := LookupResult{Address: addr}
+	loc, err := s.Lookup(addr, time.Time{})
+	if errors.Is(err, geoip.ErrInvalidAddress) {
+		r.Error = "invalid IP address"
+		return http.StatusBadRequest, r
+	}
+	if err != nil {
+		r.Error = err.Error()
+		return http.StatusNotFound, r
+	}
+
+	r.Range = loc.First.String() + "-" + loc.Last.String()
+	r.GeoID = loc.GeoID
+	r.Country = loc.Country
+	r.City = loc.City
+	r.Latitude = loc.Latitude
+	r.Longitude = loc.Longitude
+	r.Source = loc.Source
+	r.Labels = loc.Labels
+	r.Category = loc.Category
+	return http.StatusOK, r
+}
+
+func (s *Server) handleLookup(w http.ResponseWriter, req *http.Request) {
+	status, result := s.lookup(req.PathValue("ip"))
+	writeJSON(w, status, result)
+}
+
+func (s *Server) handleBatchLookup(w http.ResponseWriter, req *http.Request) {
+	addrs, err := decodeAddresses(http.MaxBytesReader(w, req.Body, MAX_BATCH_BODY))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "request body too large: more than %v bytes", MAX_BATCH_BODY)
+		return
+	case errors.Is(err, errTooManyAddresses):
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "too many addresses: more than %v", MAX_BATCH_LOOKUP)
+		return
+	case err != nil:
+		writeJSONError(w, http.StatusBadRequest, "request body must be a JSON array of addresses: %v", err)
+		return
+	}
+
+	results := make([]LookupResult, 0, len(addrs))
+	for _, addr := range addrs {
+		_, r := s.lookup(strings.TrimSpace(addr))
+		results = append(results, r)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+var errTooManyAddresses = errors.New("too many addresses")
+
+// decodeAddresses decodes the JSON array of addresses in r, element by
+// element, up to MAX_BATCH_LOOKUP.
+func decodeAddresses(r io.Reader) ([]string, error) {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('[') {
+		return nil, fmt.Errorf("not an array")
+	}
+	addrs := []string{}
+	for dec.More() {
+		if len(addrs) == MAX_BATCH_LOOKUP {
+			return nil, errTooManyAddresses
+		}
+		var addr string
+		if err := dec.Decode(&addr); err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, req *http.Request) {
+	r := s.newStatisticRequest()
+
+	format := "json"
+	args := make([]string, 0)
+	for name, values := range req.URL.Query() {
+		if strings.ToUpper(name) == "FORMAT" {
+			format = values[len(values)-1]
+			continue
+		}
+		for _, v := range values {
+			args = append(args, fmt.Sprintf("%v=%v", name, v))
+		}
+	}
+	if format != "json" {
+		args = append(args, "format="+format)
+	}
+	if err := s.parseStatArgs(&r, args); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	if format != "json" {
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+		} else {
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		r.Stream = w
+		s.serveStatistic(r)
+		return
+	}
+
+	entries := s.Statistic(r)
+
+	result := StatisticResult{Entries: make([]StatisticEntry, 0, len(entries))}
+	for _, e := range entries {
+		result.Entries = append(result.Entries, StatisticEntry{e.Name, e.Count, e.Latitude, e.Longitude, e.Group})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleReset(w http.ResponseWriter, req *http.Request) {
+	s.Incoming <- ResetRequest{}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleInfo(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, s.DB.Load().Info())
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, req *http.Request) {
+	info, err := s.Reload(req.URL.Query().Get("dir"))
+	if errors.Is(err, ErrReloadDir) {
+		writeJSONError(w, http.StatusForbidden, "%v", err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (s *Server) handleReloadOverrides(w http.ResponseWriter, req *http.Request) {
+	info, err := s.ReloadOverrides()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, s.Status())
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+func TestHandleLookup(t *testing.T) {
+	server := NewServer(geoip.NewHandle(newTestBlockDatabase(10, 2)))
+	ts := httptest.NewServer(server.httpHandler())
+	defer ts.Close()
+
+	tooMany := make([]string, MAX_BATCH_LOOKUP+1)
+	for i := range tooMany {
+		tooMany[i] = "1.0.0.1"
+	}
+	tooManyBody, _ := json.Marshal(tooMany)
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		error              string // in the JSON error body, if not empty
+	}{
+		{"GET", "/lookup/1.0.0.1", "", http.StatusOK, ""},
+		{"GET", "/lookup/bogus", "", http.StatusBadRequest, "invalid IP address"},
+		{"GET", "/lookup/9.9.9.9", "", http.StatusNotFound, "no entry matched"},
+		{"POST", "/lookup", `["1.0.0.1", "bogus", "9.9.9.9"]`, http.StatusOK, ""},
+		{"POST", "/lookup", `[]`, http.StatusOK, ""},
+		{"POST", "/lookup", `{"addresses": []}`, http.StatusBadRequest, "JSON array"},
+		{"POST", "/lookup", `["1.0.0.1", 3]`, http.StatusBadRequest, "JSON array"},
+		{"POST", "/lookup", `["1.0.0.1"`, http.StatusBadRequest, "JSON array"},
+		{"POST", "/lookup", string(tooManyBody), http.StatusRequestEntityTooLarge, "too many addresses"},
+		{"POST", "/lookup", `["` + strings.Repeat("1", MAX_BATCH_BODY) + `"]`, http.StatusRequestEntityTooLarge, "too large"},
+		{"GET", "/stats?limit=bogus", "", http.StatusBadRequest, "bogus"},
+	}
+	for _, test := range tests {
+		name := fmt.Sprintf("%v %v", test.method, test.path)
+		req, err := http.NewRequest(test.method, ts.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		var body map[string]any
+		var results []LookupResult
+		if test.method == "POST" && test.status == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&results)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&body)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%v: status %v, expected %v", name, resp.StatusCode, test.status)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%v: content type %q", name, ct)
+		}
+		if err != nil {
+			t.Errorf("%v: invalid JSON body: %v", name, err)
+			continue
+		}
+		if test.error != "" {
+			if msg, _ := body["error"].(string); !strings.Contains(msg, test.error) {
+				t.Errorf("%v: error %q, expected %q in it", name, msg, test.error)
+			}
+		}
+	}
+}
+
+func TestHandleLookup_Results(t *testing.T) {
+	server := NewServer(geoip.NewHandle(newTestBlockDatabase(10, 2)))
+	ts := httptest.NewServer(server.httpHandler())
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/lookup", "application/json", strings.NewReader(`["1.0.1.1", " bogus ", "9.9.9.9"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var results []LookupResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("%v results, expected 3", len(results))
+	}
+	if r := results[0]; r.Error != "" || r.Range != "1.0.1.0-1.0.1.255" || r.Country != "ZZ" || r.City != "City1" {
+		t.Errorf("unexpected result: %+v", r)
+	}
+	if r := results[1]; r.Error != "invalid IP address" {
+		t.Errorf("unexpected result: %+v", r)
+	}
+	if r := results[2]; r.Error == "" || r.Range != "" {
+		t.Errorf("unexpected result: %+v", r)
+	}
+}
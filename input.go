@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// InputSummary records how many lines were read from an input source,
+// and how many of them were found in the block database.
+type InputSummary struct {
+	Name    string
+	Lines   int
+	Matches int
+	Error   error
+}
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// ExpandInputs expands shell glob patterns in the list of input names.
+// A name without any glob meta character is kept as is, so that a
+// missing file is reported when it is opened.  "-" means the standard
+// input.
+func ExpandInputs(patterns []string) ([]string, error) {
+	names := make([]string, 0, len(patterns))
+
+	for _, pat := range patterns {
+		if pat == "-" || !strings.ContainsAny(pat, "*?[") {
+			names = append(names, pat)
+			continue
+		}
+		matches, err := filepath.Glob(pat)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %v: %v", pat, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no file matched to %v", pat)
+		}
+		names = append(names, matches...)
+	}
+	return names, nil
+}
+
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *commandReader) Close() error {
+	r.ReadCloser.Close()
+	return r.cmd.Wait()
+}
+
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiCloser) Close() error {
+	var err error
+	for _, c := range m.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// decompressCommand runs the command name to decompress src; the command
+// is looked up in PATH first, so a missing one is reported before reading.
+func decompressCommand(src io.Reader, name string, args ...string) (io.ReadCloser, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("%v(1) is needed to decompress the %v input, but not found in PATH", name, name)
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = src
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot run %v: %v", name, err)
+	}
+	return &commandReader{ReadCloser: out, cmd: cmd}, nil
+}
+
+// NewDecompressReader detects the compression format of src by its magic
+// number, and returns a reader of the decompressed contents.  gzip and
+// bzip2 are handled in-process; zstd and xz are delegated to the zstd(1)
+// and xz(1) commands.  Uncompressed input is returned as is.
+func NewDecompressReader(src io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(src)
+	magic, _ := br.Peek(len(xzMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return decompressCommand(br, "zstd", "-dc")
+	case bytes.HasPrefix(magic, xzMagic):
+		return decompressCommand(br, "xz", "-dc")
+	}
+	return io.NopCloser(br), nil
+}
+
+// OpenInput opens the input file, or the standard input if filename is
+// "-", and transparently decompresses it.
+func OpenInput(filename string) (io.ReadCloser, error) {
+	var f *os.File
+	if filename == "-" {
+		f = os.Stdin
+	} else {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		f = file
+	}
+
+	r, err := NewDecompressReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &multiCloser{Reader: r, closers: []io.Closer{r, f}}, nil
+}
+
+const CLF_TIME_LAYOUT = "02/Jan/2006:15:04:05 -0700"
+
+// ParseLine returns the address part of an input line, which is the
+// first field of the line, and the timestamp of the line if any.  This
+// allows feeding web server access logs (e.g. nginx combined log format)
+// as well as plain lists of addresses.  The timestamp is either in the
+// common log format within brackets, or any RFC 3339 field.
+func ParseLine(line string) (string, time.Time) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", time.Time{}
+	}
+	return fields[0], lineTime(line, fields[1:])
+}
+
+func lineTime(line string, fields []string) time.Time {
+	if begin := strings.IndexByte(line, '['); begin >= 0 {
+		if end := strings.IndexByte(line[begin:], ']'); end > 0 {
+			if t, err := time.Parse(CLF_TIME_LAYOUT, line[begin+1:begin+end]); err == nil {
+				return t
+			}
+		}
+	}
+	for _, f := range fields {
+		f = strings.Trim(f, "\"',[]")
+		if len(f) < len("2006-01-02T15:04:05Z") || f[4] != '-' {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339Nano, f); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// FeedInput looks up the address of every non-empty line of reader, and
+// counts the lines and the matched addresses.
+func FeedInput(server *Server, name string, reader io.Reader) InputSummary {
+	summary := InputSummary{Name: name}
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		addr, t := ParseLine(scanner.Text())
+		if addr == "" {
+			continue
+		}
+		summary.Lines++
+
+		if _, err := server.Lookup(addr, t); err == nil {
+			summary.Matches++
+		}
+	}
+	summary.Error = scanner.Err()
+	return summary
+}
+
+// FeedFile opens the named input and feeds it to the server.
+func FeedFile(server *Server, filename string) InputSummary {
+	f, err := OpenInput(filename)
+	if err != nil {
+		return InputSummary{Name: filename, Error: err}
+	}
+	summary := FeedInput(server, filename, f)
+	if err := f.Close(); err != nil && summary.Error == nil {
+		summary.Error = err
+	}
+	return summary
+}
+
+// WriteInputSummary prints one line per input source with the number of
+// lines read and matched, followed by the total.
+func WriteInputSummary(out io.Writer, summaries []InputSummary) {
+	total := InputSummary{Name: "total"}
+
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "# %-40s %10s %10s\n", "input", "lines", "matched")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "# %-40s %10d %10d", s.Name, s.Lines, s.Matches)
+		if s.Error != nil {
+			fmt.Fprintf(w, "  (error: %v)", s.Error)
+		}
+		fmt.Fprintf(w, "\n")
+		total.Lines += s.Lines
+		total.Matches += s.Matches
+	}
+	fmt.Fprintf(w, "# %-40s %10d %10d\n", total.Name, total.Lines, total.Matches)
+}
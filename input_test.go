@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+func TestExpandInputs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"access.log", "access.log.1.gz", "access.log.2.gz", "error.log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	join := func(names ...string) []string {
+		for i, name := range names {
+			if name != "-" {
+				names[i] = filepath.Join(dir, name)
+			}
+		}
+		return names
+	}
+
+	tests := []struct {
+		patterns []string
+		expected []string
+	}{
+		{join("access.log*"), join("access.log", "access.log.1.gz", "access.log.2.gz")},
+		{join("access.log.?.gz", "-"), join("access.log.1.gz", "access.log.2.gz", "-")},
+		{join("-", "error.log", "missing.log"), join("-", "error.log", "missing.log")},
+		{join("[ae]*.log"), join("access.log", "error.log")},
+	}
+	for _, test := range tests {
+		names, err := ExpandInputs(test.patterns)
+		if err != nil {
+			t.Errorf("%v: %v", test.patterns, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.patterns, test.expected, names)
+		}
+	}
+
+	for _, pat := range []string{filepath.Join(dir, "*.txt"), filepath.Join(dir, "[")} {
+		if names, err := ExpandInputs([]string{pat}); err == nil {
+			t.Errorf("%v: no error, got %v", pat, names)
+		}
+	}
+}
+
+func TestOpenInput_Compressed(t *testing.T) {
+	expected, err := os.ReadFile("testdata/input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"testdata/input.txt", "testdata/input.txt.gz", "testdata/input.txt.bz2"} {
+		f, err := OpenInput(name)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+		} else if !bytes.Equal(data, expected) {
+			t.Errorf("%v: expected %q, got %q", name, expected, data)
+		}
+	}
+}
+
+func TestOpenInput_Stdin(t *testing.T) {
+	f, err := os.Open("testdata/input.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdin := os.Stdin
+	os.Stdin = f
+	defer func() { os.Stdin = stdin }()
+
+	r, err := OpenInput("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "1.0.0.1\n") {
+		t.Errorf("unexpected input: %q", data)
+	}
+}
+
+func TestNewDecompressReader_MissingCommand(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	for _, test := range []struct {
+		name  string
+		magic []byte
+	}{{"zstd", zstdMagic}, {"xz", xzMagic}} {
+		_, err := NewDecompressReader(bytes.NewReader(test.magic))
+		if err == nil || !strings.Contains(err.Error(), test.name+"(1)") {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+		}
+	}
+}
+
+func TestNewDecompressReader_Command(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz is not installed")
+	}
+	cmd := exec.Command("xz", "-c")
+	cmd.Stdin = strings.NewReader("1.0.0.1\n")
+	compressed, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewDecompressReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err := r.Close(); err != nil {
+		t.Error(err)
+	}
+	if err != nil || string(data) != "1.0.0.1\n" {
+		t.Errorf("unexpected input: %q, %v", data, err)
+	}
+}
+
+func TestFeedFile(t *testing.T) {
+	server := NewServer(geoip.NewHandle(newTestBlockDatabase(10, 2)))
+
+	var summaries []InputSummary
+	for _, name := range []string{"testdata/input.txt.gz", "testdata/input.txt.bz2", "testdata/missing.txt"} {
+		summaries = append(summaries, FeedFile(server, name))
+	}
+	for _, s := range summaries[:2] {
+		if s.Error != nil || s.Lines != 4 || s.Matches != 3 {
+			t.Errorf("%v: unexpected summary %+v", s.Name, s)
+		}
+	}
+	if s := summaries[2]; s.Error == nil || s.Lines != 0 {
+		t.Errorf("%v: unexpected summary %+v", s.Name, s)
+	}
+
+	var out bytes.Buffer
+	WriteInputSummary(&out, summaries)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("unexpected summary:\n%v", out.String())
+	}
+	if fields := strings.Fields(lines[4]); !reflect.DeepEqual(fields, []string{"#", "total", "8", "6"}) {
+		t.Errorf("unexpected total: %q", lines[4])
+	}
+	if !strings.Contains(lines[3], "(error: ") {
+		t.Errorf("error not reported: %q", lines[3])
+	}
+
+	total := 0
+	for _, e := range server.population.Entries(0, time.Time{}) {
+		total += e.Count
+	}
+	if total != 6 {
+		t.Errorf("population total = %v, expected 6", total)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line, addr string
+		time       string // RFC 3339, or empty for no timestamp
+	}{
+		{"1.2.3.4", "1.2.3.4", ""},
+		{"   ", "", ""},
+		{"  1.2.3.4  \t", "1.2.3.4", ""},
+		{`1.2.3.4 - - [19/Oct/2026:09:00:00 +0900] "GET / HTTP/1.1" 200 512`, "1.2.3.4", "2026-10-19T00:00:00Z"},
+		{`::1 - frank [19/Oct/2026:09:00:00 -0700] "GET / HTTP/1.1" 200 512`, "::1", "2026-10-19T16:00:00Z"},
+		{"1.2.3.4 2026-10-19T09:00:00Z GET /", "1.2.3.4", "2026-10-19T09:00:00Z"},
+		{"1.2.3.4 2026-10-19T09:00:00.25+02:00", "1.2.3.4", "2026-10-19T07:00:00.25Z"},
+		{`1.2.3.4 "2026-10-19T09:00:00Z",GET`, "1.2.3.4", ""},
+		{`1.2.3.4 "2026-10-19T09:00:00Z" GET`, "1.2.3.4", "2026-10-19T09:00:00Z"},
+		{"1.2.3.4 [2026-10-19T09:00:00Z] GET", "1.2.3.4", "2026-10-19T09:00:00Z"},
+		{"1.2.3.4 [bogus] 2026-10-19T09:00:00Z", "1.2.3.4", "2026-10-19T09:00:00Z"},
+		{"1.2.3.4 [19/Oct/2026:09:00:00] 2026-10-19", "1.2.3.4", ""},
+		{"1.2.3.4 2026-13-19T09:00:00Z", "1.2.3.4", ""},
+	}
+	for _, test := range tests {
+		addr, tm := ParseLine(test.line)
+		var expected time.Time
+		if test.time != "" {
+			expected, _ = time.Parse(time.RFC3339Nano, test.time)
+		}
+		if addr != test.addr || !tm.Equal(expected) {
+			t.Errorf("%q: expected %q %v, got %q %v", test.line, test.addr, expected, addr, tm)
+		}
+	}
+}
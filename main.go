@@ -1,7 +1,11 @@
+// The HTTP interface uses the method and wildcard patterns of ServeMux,
+// which are off by default when built in GOPATH mode.
+//
+//go:debug httpmuxgo121=0
+
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -11,62 +15,214 @@ import (
 	"path"
 	"strings"
 	"syscall"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
 )
 
 var ProgramName string
 
-var CityDB *CityDatabase
-var BlockDB *BlockDatabase
-
 var dbDirectory string
+var backendName string
+var comparePath string
+var compareBackend string
+var compareAll bool
+var diffPath string
+var overrideFile string
+var snapshotFile string
+var validatePath string
+var validateFormat string
+var diffFormat string
 var dbURL string
+var editionList string
+var maxmindURL string
+var accountID string
+var licenseKey string
+var licenseKeyFile string
+var expectedSHA256 string
+var verifyChecksum bool
 var cityDBName string
 var blockDBName string
 var noCleanUp bool
-var inputFile *os.File
+var workDirectory string
+var cacheDirectory string
+var noCache bool
+var cacheKeep int
+var cacheMaxAge time.Duration
+var offlineMode bool
+var httpTimeout time.Duration
+var proxyURL string
+var downloadRetries int
+var showProgress bool
 var inputFilename string
 var verboseMode bool
 var limitCount int
 var includeUnknown bool
+var includeSpecial bool
+var reloadDirs bool
 var formatter Formatter
 var formatterName string
 var fieldOrder string
 var fieldSeparator string
 var tcpAddress string
+var httpAddress string
 var numGroups int
 var numGroupIteration int
+var followMode bool
+var reportInterval int
+var reportLines int
+var reportFilename string
+var statWindow time.Duration
+var statCacheTTL time.Duration
+var updateInterval time.Duration
+var aggregationKey string
+var seriesBucket time.Duration
+var seriesFormat string
+var mapOutput string
+var mapWidth int
+var mapDelay int
 
 func init() {
 	ProgramName = path.Base(os.Args[0])
 
-	flag.StringVar(&dbURL, "u", GEOLITE_ARCHIVE_URL, "url of MaxMind geolocation database (zip)")
-	flag.StringVar(&dbDirectory, "d", "", "directory of GeoDB")
+	flag.StringVar(&comparePath, "compare", "", "compare the locations of the inputs with the database at this path, instead of the statistics")
+	flag.StringVar(&compareBackend, "compare-backend", "", "backend of the -compare or -diff database (default -backend)")
+	flag.BoolVar(&compareAll, "compare-all", false, "print every compared address, not only the disagreeing ones")
+	flag.StringVar(&diffPath, "diff", "", "print the ranges that changed from the database to the one at this path, and exit")
+	flag.StringVar(&diffFormat, "diff-format", "csv", "diff format: csv or json")
+	flag.StringVar(&snapshotFile, "snapshot", "", "file of a snapshot of the loaded maxmind-csv database, mapped into memory on the next start instead of loading the CSV files")
+	flag.StringVar(&validatePath, "validate", "", "check the CSV files of the database directory at this path, print the problems, and exit with 1 if any is an error")
+	flag.StringVar(&validateFormat, "validate-format", "text", "validation report format: text or json")
+	flag.StringVar(&overrideFile, "overrides", "", "CSV or YAML file of the locations of networks that take precedence over the database")
+	flag.StringVar(&dbURL, "u", "", "url of geolocation database archive (zip or tar.gz), instead of MaxMind editions")
+	flag.StringVar(&editionList, "e", DEFAULT_EDITION, "comma separated MaxMind edition IDs to download")
+	flag.StringVar(&maxmindURL, "maxmind-url", MAXMIND_DOWNLOAD_URL, "base url of MaxMind downloads")
+	flag.StringVar(&accountID, "account-id", "", "MaxMind account ID (default $MAXMIND_ACCOUNT_ID)")
+	flag.StringVar(&licenseKey, "license-key", "", "MaxMind license key (default $MAXMIND_LICENSE_KEY)")
+	flag.StringVar(&licenseKeyFile, "license-key-file", "", "file containing MaxMind license key (default $MAXMIND_LICENSE_KEY_FILE)")
+	flag.StringVar(&expectedSHA256, "sha256", "", "expected SHA-256 digest (hex) of the archive given by -u")
+	flag.BoolVar(&verifyChecksum, "verify", true, "verify the archive against the .sha256 file published next to it")
+	flag.StringVar(&dbDirectory, "d", "", "directory of GeoDB (or file, depending on -backend)")
+	flag.StringVar(&backendName, "backend", geoip.BACKEND_MAXMIND_CSV, "database backend: "+strings.Join(geoip.Backends(), ", "))
 	flag.StringVar(&cityDBName, "c", GEOLITE_CITY_CSV_FILE, "city db filename")
 	flag.StringVar(&blockDBName, "b", GEOLITE_BLOCK_CSV_FILE, "block db filename")
+	flag.StringVar(&workDirectory, "w", "", "working directory of the downloaded archives and unpacked files (default $TMPDIR or /tmp)")
+	flag.StringVar(&cacheDirectory, "cache-dir", "", "directory of the cached databases (default $XDG_CACHE_HOME/goip)")
+	flag.BoolVar(&noCache, "no-cache", false, "do not cache the downloaded database")
+	flag.IntVar(&cacheKeep, "cache-keep", 3, "number of cached database versions to keep, 0 to keep all")
+	flag.DurationVar(&cacheMaxAge, "cache-max-age", 24*time.Hour, "use the cached database without checking for a newer one if checked within the duration")
+	flag.BoolVar(&offlineMode, "offline", false, "never access the network; use the newest cached database")
+	flag.DurationVar(&httpTimeout, "http-timeout", DEFAULT_HTTP_TIMEOUT, "timeout of connecting and of a stalled transfer of the downloads")
+	flag.StringVar(&proxyURL, "proxy", "", "proxy url of the downloads (default $HTTPS_PROXY or $HTTP_PROXY)")
+	flag.IntVar(&downloadRetries, "retries", DEFAULT_RETRIES, "number of retries of a failed download")
+	flag.BoolVar(&showProgress, "progress", isTerminal(os.Stderr), "show the download progress on the standard error")
 	flag.BoolVar(&noCleanUp, "n", false, "do not remove the downloaded files.")
+	flag.DurationVar(&updateInterval, "update-interval", 0, "check the url for a new database every given duration (e.g. 24h), 0 to disable")
 	flag.BoolVar(&verboseMode, "v", false, "quiet mode")
 	flag.BoolVar(&includeUnknown, "U", false, "do not remove unknown")
+	flag.BoolVar(&reloadDirs, "reload-dir", false, "let the clients of .reload and POST /reload give the directory to reload from")
+	flag.BoolVar(&includeSpecial, "special", true, "count private, CGNAT and other special-purpose addresses under their category (e.g. PRIVATE)")
 	flag.IntVar(&limitCount, "l", 1000, "print only top n elements")
 
-	flag.StringVar(&inputFilename, "i", "", "do not remove the downloaded files.")
+	flag.StringVar(&inputFilename, "i", "", "input file (same as giving it as an argument)")
 
 	flag.StringVar(&formatterName, "t", "csv", "formatter type: csv or text")
 	flag.StringVar(&fieldSeparator, "f", "\t", "field separator for text formatter")
 	flag.StringVar(&fieldOrder, "o", "name,pop,lat,lon,group", "field order of name, pop, lat, lon, and group")
 
 	flag.StringVar(&tcpAddress, "T", "", "enable server mode, tcp address:port for listening socket")
+	flag.StringVar(&httpAddress, "H", "", "enable HTTP/JSON server, tcp address:port for listening socket")
 	flag.IntVar(&numGroups, "g", 5, "number of groups for clustering the output")
 	flag.IntVar(&numGroupIteration, "G", 20, "number of iteration for grouping/clustering")
 
+	flag.BoolVar(&followMode, "F", false, "follow the input files like tail -F, and report periodically")
+	flag.IntVar(&reportInterval, "r", 10, "report every n seconds in follow mode, 0 to disable")
+	flag.IntVar(&reportLines, "R", 0, "report every n lines in follow mode, 0 to disable")
+	flag.DurationVar(&statWindow, "window", 0, "report only the last given duration (e.g. 5m), up to 24h")
+	flag.DurationVar(&statCacheTTL, "stat-ttl", 0, "serve the same statistics request from the cache for the given duration")
+	flag.StringVar(&aggregationKey, "key", KEY_CITY, "aggregation key: city or country")
+	flag.DurationVar(&seriesBucket, "series", 0, "print counts per time bucket of given size (e.g. 1m) instead of the statistics")
+	flag.StringVar(&seriesFormat, "series-format", "csv", "time series format: csv or ndjson")
+	flag.StringVar(&mapOutput, "map", "", "render a map frame per time series bucket to this file (.gif, or .png/.svg series)")
+	flag.IntVar(&mapWidth, "map-width", 1024, "width of the map frames in pixels")
+	flag.IntVar(&mapDelay, "map-delay", 50, "delay between animated map frames in 1/100 seconds")
+	flag.StringVar(&reportFilename, "O", "", "write the periodic reports to this file instead of the standard output")
+
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [OPTION...]\n", ProgramName)
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTION...] [FILE...]\n", ProgramName)
 		fmt.Fprintf(os.Stderr, "Print Geolocation of given IP addresses\n")
 		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "FILE may be a glob pattern, or - for the standard input.  gzip, bzip2,\n")
+		fmt.Fprintf(os.Stderr, "zstd and xz compressed files are decompressed transparently.\n")
+		fmt.Fprintf(os.Stderr, "\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\n")
 	}
 }
 
+// databaseURLs returns the urls of the database archives to download,
+// and the credentials for them.  They are the url given by -u, or the
+// MaxMind permalinks of the editions given by -e.
+func databaseURLs() ([]string, MaxMindCredentials, error) {
+	cred, err := LoadMaxMindCredentials(accountID, licenseKey, licenseKeyFile)
+	if err != nil {
+		return nil, cred, err
+	}
+	if expectedSHA256 != "" {
+		if dbURL == "" {
+			return nil, cred, fmt.Errorf("-sha256 requires -u")
+		}
+		if expectedSHA256, err = ParseSHA256(expectedSHA256); err != nil {
+			return nil, cred, err
+		}
+	}
+	if dbURL != "" {
+		if !IsMaxMindURL(dbURL) {
+			// never send the credentials to a mirror
+			cred = MaxMindCredentials{}
+		}
+		return []string{dbURL}, cred, nil
+	}
+	if cred.LicenseKey == "" {
+		return nil, cred, fmt.Errorf("MaxMind downloads require a license key; use -license-key, -license-key-file or $MAXMIND_LICENSE_KEY (sign up at https://www.maxmind.com/en/geolite2/signup), or -d with a downloaded database")
+	}
+
+	editions, err := ParseEditions(editionList)
+	if err != nil {
+		return nil, cred, err
+	}
+	urls := make([]string, 0, len(editions))
+	for _, e := range editions {
+		urls = append(urls, MaxMindURL(maxmindURL, e, cred))
+	}
+	return urls, cred, nil
+}
+
+// databaseSource returns the name of the downloaded database in the
+// cache: the url given by -u, or the editions given by -e.
+func databaseSource() (string, error) {
+	if dbURL != "" {
+		return redactURL(dbURL), nil
+	}
+	editions, err := ParseEditions(editionList)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(editions, ","), nil
+}
+
+// newStatisticRequest returns a StatisticRequest filled from the command
+// line options.  The caller still needs to set Stream and Done.
+func newStatisticRequest(formatter Formatter) StatisticRequest {
+	return StatisticRequest{
+		Limit:             limitCount,
+		Formatter:         formatter,
+		Groups:            numGroups,
+		MaxGroupIteration: numGroupIteration,
+		Window:            statWindow,
+	}
+}
+
 func main() {
 	if os.Getenv("DEBUG") == "" {
 		log.SetOutput(ioutil.Discard)
@@ -89,41 +245,248 @@ func main() {
 		Err(1, err, "cannot create a formatter")
 	}
 
-	downloader := Downloader{}
-	if dbDirectory == "" {
-		err := downloader.Fetch(dbURL)
-		if err != nil {
-			Err(1, err, "cannott fetch url, %s", dbURL)
+	if aggregationKey != KEY_CITY && aggregationKey != KEY_COUNTRY {
+		Err(1, nil, "unknown aggregation key: %v", aggregationKey)
+	}
+	if err := CheckSeriesFormat(seriesFormat); err != nil {
+		Err(1, err, "invalid time series format")
+	}
+	if err := CheckDiffFormat(diffFormat); err != nil {
+		Err(1, err, "invalid diff format")
+	}
+	if err := CheckValidateFormat(validateFormat); err != nil {
+		Err(1, err, "invalid validation report format")
+	}
+	if mapOutput != "" && seriesBucket <= 0 {
+		Err(1, nil, "--map requires --series BUCKET")
+	}
+	if seriesBucket > 0 && (tcpAddress != "" || httpAddress != "" || followMode) {
+		// the series grows with every bucket, and is only written at the
+		// end of the input
+		Err(1, nil, "--series and --map are not supported with -T, -H or -F")
+	}
+
+	if backendName != geoip.BACKEND_MAXMIND_CSV && dbDirectory == "" {
+		Err(1, nil, "--backend %v requires -d", backendName)
+	}
+
+	if validatePath != "" {
+		if backendName != geoip.BACKEND_MAXMIND_CSV {
+			Err(1, nil, "--validate supports only the %v backend", geoip.BACKEND_MAXMIND_CSV)
 		}
-		err = downloader.Unpack()
+		report, err := geoip.ValidateRelease(validatePath, geoip.Options{BlockFile: blockDBName, CityFile: cityDBName})
 		if err != nil {
-			Err(1, err, "cannot unpack the archive")
+			Err(1, err, "cannot validate %v", validatePath)
 		}
+		if err := WriteValidationReport(os.Stdout, validateFormat, report); err != nil {
+			Err(1, err, "cannot write the validation report")
+		}
+		if !report.OK() {
+			os.Exit(1)
+		}
+		return
+	}
 
-		dbDirectory = downloader.Base
+	// without -d, reload downloads the database again
+	reloadDirectory := dbDirectory
+
+	var cache *DatabaseCache
+	if !noCache {
+		cache = &DatabaseCache{Dir: cacheDirectory, Keep: cacheKeep}
+		if cache.Dir == "" {
+			cache.Dir = DefaultCacheDir()
+		}
+	}
+	source, err := databaseSource()
+	if err != nil {
+		Err(1, err, "invalid database source")
 	}
 
-	if inputFilename == "" {
-		inputFile = os.Stdin
+	var urls []string
+	var cred MaxMindCredentials
+	if offlineMode {
+		if cache == nil {
+			Err(1, nil, "--offline cannot be used with --no-cache")
+		}
+		if updateInterval > 0 {
+			Err(1, nil, "--update-interval cannot be used with --offline")
+		}
 	} else {
-		f, err := os.Open(inputFilename)
+		urls, cred, err = databaseURLs()
+		if err != nil && (dbDirectory == "" || updateInterval > 0) {
+			Err(1, err, "cannot download the database")
+		}
+	}
+
+	client, err := NewHTTPClient(httpTimeout, proxyURL)
+	if err != nil {
+		Err(1, err, "invalid HTTP client settings")
+	}
+	downloadSettings := Downloader{
+		Username:       cred.AccountID,
+		Password:       cred.LicenseKey,
+		Checksum:       expectedSHA256,
+		VerifyChecksum: verifyChecksum,
+		WorkDir:        workDirectory,
+		Client:         client,
+		Retries:        downloadRetries,
+		StallTimeout:   httpTimeout,
+	}
+	downloader := downloadSettings
+	if showProgress {
+		downloader.Progress = os.Stderr
+	}
+	release := ""
+	switch {
+	case dbDirectory != "":
+	case offlineMode:
+		entry, err := cache.Latest(source)
 		if err != nil {
-			Err(1, err, "cannot open the input file %s", inputFilename)
+			Err(1, err, "cannot use the cached database of %v in %v", source, cache.Dir)
 		}
-		defer f.Close()
-		inputFile = f
+		dbDirectory, release = entry.Dir, entry.Release
+	case cache != nil:
+		entry, err := cache.Get(&downloader, urls, source, cacheMaxAge)
+		if err != nil && err != ErrNotModified {
+			Err(1, err, "cannot download the database")
+		}
+		dbDirectory, release = entry.Dir, entry.Release
+	default:
+		if err := downloader.Download(urls); err != nil {
+			Err(1, err, "cannot download the database")
+		}
+		dbDirectory, release = downloader.Base, downloader.Release
 	}
 
-	CityDB, err := NewCityDatabase(path.Join(dbDirectory, cityDBName))
+	inputs := flag.Args()
+	if inputFilename != "" {
+		inputs = append([]string{inputFilename}, inputs...)
+	}
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	inputs, err = ExpandInputs(inputs)
 	if err != nil {
-		Err(1, err, "cannot load city database")
+		Err(1, err, "cannot expand the input files")
 	}
-	BlockDB, err = NewBlockDatabase(path.Join(dbDirectory, blockDBName), CityDB)
+	log.Printf("inputs: %v", inputs)
+
+	dbOptions := geoip.Options{BlockFile: blockDBName, CityFile: cityDBName, Logger: log.Default()}
+	openOptions := dbOptions
+	openOptions.Snapshot = snapshotFile
+	if downloader.Archive != "" {
+		openOptions.Source = redactURL(urls[0])
+	}
+	openOptions.BuildDate = geoip.ReleaseBuildDate(release)
+	db, err := geoip.OpenBackend(backendName, dbDirectory, openOptions)
 	if err != nil {
-		Err(1, err, "cannot load block database")
+		Err(1, err, "cannot load the database")
 	}
+	log.Printf("database: %v", db.Info())
 
-	server := NewServer()
+	if compareBackend == "" {
+		compareBackend = backendName
+	}
+	if diffPath != "" {
+		other, err := geoip.OpenBackend(compareBackend, diffPath, dbOptions)
+		if err != nil {
+			Err(1, err, "cannot load the database to diff")
+		}
+		if !noCleanUp {
+			downloader.Close()
+		}
+		if err := WriteDiff(os.Stdout, os.Stderr, diffFormat, db, other); err != nil {
+			Err(1, err, "cannot diff the databases")
+		}
+		return
+	}
+	overlay := &geoip.Overlay{Database: db}
+	if overrideFile != "" {
+		overlay.Overrides, err = geoip.LoadOverrides(overrideFile)
+		if err != nil {
+			Err(1, err, "cannot load the overrides")
+		}
+		log.Printf("overrides: %v networks from %v", len(overlay.Overrides.Entries), overrideFile)
+	}
+	db = overlay
+	if comparePath != "" {
+		other, err := geoip.OpenBackend(compareBackend, comparePath, dbOptions)
+		if err != nil {
+			Err(1, err, "cannot load the database to compare")
+		}
+		// the same overrides on both sides, so only the databases differ
+		other = &geoip.Overlay{Database: other, Overrides: overlay.Overrides}
+		comparison := NewComparison(db, other)
+		summaries := make([]InputSummary, 0, len(inputs))
+		for _, name := range inputs {
+			summary := comparison.FeedFile(name)
+			if summary.Error != nil {
+				Err(0, summary.Error, "reading the file %v", name)
+			}
+			summaries = append(summaries, summary)
+		}
+		if !noCleanUp {
+			downloader.Close()
+		}
+		if err := comparison.WriteAddresses(os.Stdout, compareAll); err != nil {
+			Err(1, err, "cannot write the comparison")
+		}
+		if len(summaries) > 1 || verboseMode {
+			WriteInputSummary(os.Stderr, summaries)
+		}
+		WriteComparisonSummary(os.Stderr, db.Info(), other.Info(), comparison.Summary())
+		return
+	}
+
+	handle := geoip.NewHandle(db)
+
+	var renderer *MapRenderer
+	if mapOutput != "" {
+		renderer, err = NewMapRenderer(db, mapOutput, mapWidth, mapDelay)
+		if err != nil {
+			Err(1, err, "cannot create the map renderer")
+		}
+	}
+
+	server := NewServer(handle)
+	server.Verbose = verboseMode
+	server.IncludeUnknown = includeUnknown
+	server.IncludeSpecial = includeSpecial
+	server.ReloadDirs = reloadDirs
+	server.Key = aggregationKey
+	server.StatDefaults = newStatisticRequest(nil)
+	server.FieldOrder = fieldOrder
+	server.FieldSeparator = fieldSeparator
+	server.StatCache.TTL = statCacheTTL
+	reloadOptions := dbOptions
+	reloadOptions.Snapshot = snapshotFile
+	server.Reloader = &Reloader{
+		DB:           handle,
+		Backend:      backendName,
+		Options:      reloadOptions,
+		OverrideFile: overrideFile,
+		Directory:    reloadDirectory,
+		URLs:         urls,
+		Downloader:   downloadSettings,
+		Cache:        cache,
+		Source:       source,
+		Offline:      offlineMode,
+		NoCleanUp:    noCleanUp,
+		ETag:         downloader.ETag,
+		LastModified: downloader.LastModified,
+	}
+	if cache != nil && reloadDirectory == "" {
+		server.Reloader.cacheDir = dbDirectory
+	}
+	if updateInterval > 0 {
+		server.Updater = NewUpdater(server.Reloader, updateInterval)
+		updaterQuit := make(chan struct{})
+		defer close(updaterQuit)
+		go server.Updater.Run(updaterQuit)
+	}
+	if seriesBucket > 0 {
+		server.Series = NewTimeSeries(seriesBucket)
+	}
 	server.Start()
 
 	if tcpAddress != "" {
@@ -131,42 +494,78 @@ func main() {
 		server.AddListener("tcp", tcpAddress)
 		fmt.Fprintf(os.Stderr, "server ready\n")
 	}
+	if httpAddress != "" {
+		log.Printf("HTTP address: %v", httpAddress)
+		if err := server.AddHTTPListener(httpAddress); err != nil {
+			Err(1, err, "cannot listen on %v", httpAddress)
+		}
+		fmt.Fprintf(os.Stderr, "http server ready\n")
+	}
 	defer server.Close()
 
-	scanner := bufio.NewScanner(inputFile)
-
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, os.Interrupt)
 	signal.Notify(signalChannel, os.Kill)
 
-	stdinDone := make(chan struct{})
+	hupChannel := make(chan os.Signal, 1)
+	signal.Notify(hupChannel, syscall.SIGHUP)
 	go func() {
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			// fmt.Fprintf(os.Stderr, "# line: %s\n", line)
-			if line == "" {
+		for range hupChannel {
+			fmt.Fprintf(os.Stderr, "reloading the database\n")
+			info, err := server.Reload("")
+			if err != nil {
+				Err(0, err, "cannot reload the database")
 				continue
 			}
-
-			server.Incoming <- LocationRequest{Address: line}
-		}
-		if err := scanner.Err(); err != nil {
-			Err(1, err, "reading the file %v", inputFile.Name())
+			fmt.Fprintf(os.Stderr, "database reloaded: %v\n", info)
 		}
+	}()
 
-		done := make(chan struct{})
-		NewFormatter(formatterName, fieldOrder, fieldSeparator)
-		server.Incoming <- StatisticRequest{
-			Limit:             limitCount,
-			Stream:            os.Stdout,
-			Formatter:         formatter,
-			Done:              done,
-			Groups:            numGroups,
-			MaxGroupIteration: numGroupIteration,
+	stdinDone := make(chan struct{})
+	if followMode {
+		reporter := &Reporter{
+			Server:   server,
+			Filename: reportFilename,
+			Stream:   os.Stdout,
+			Template: newStatisticRequest(formatter),
 		}
-		<-done
-		close(stdinDone)
-	}()
+		interval := time.Duration(reportInterval) * time.Second
+		quit := make(chan struct{})
+		defer close(quit)
+		go FollowInputs(server, inputs, reporter, interval, reportLines, quit)
+	} else {
+		go func() {
+			summaries := make([]InputSummary, 0, len(inputs))
+			for _, name := range inputs {
+				summary := FeedFile(server, name)
+				if summary.Error != nil {
+					Err(0, summary.Error, "reading the file %v", name)
+				}
+				summaries = append(summaries, summary)
+			}
+
+			if renderer != nil {
+				r := MapRequest{Renderer: renderer, Done: make(chan struct{})}
+				server.Incoming <- r
+				<-r.Done
+			} else if server.Series != nil {
+				r := SeriesRequest{Format: seriesFormat, Stream: os.Stdout, Done: make(chan struct{})}
+				server.Incoming <- r
+				<-r.Done
+			} else {
+				r := newStatisticRequest(formatter)
+				r.Stream = os.Stdout
+				r.Done = make(chan struct{})
+				server.Incoming <- r
+				<-r.Done
+			}
+
+			if len(summaries) > 1 || verboseMode {
+				WriteInputSummary(os.Stderr, summaries)
+			}
+			close(stdinDone)
+		}()
+	}
 
 	select {
 	case <-stdinDone:
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+const MAX_MAP_FRAMES = 500
+
+// An animated GIF keeps all of its frames in memory, one byte per pixel.
+const MAX_MAP_GIF_PIXELS = 256 << 20
+
+// frameVerb is the printf verb for the frame number in a file name; any
+// other '%' is taken literally.
+var frameVerb = regexp.MustCompile(`%(0[0-9]+)?d`)
+
+const (
+	MAP_BACKGROUND uint8 = iota
+	MAP_LAND
+	MAP_BUBBLE
+	MAP_CAPTION
+)
+
+var mapPalette = color.Palette{
+	MAP_BACKGROUND: color.RGBA{16, 24, 40, 255},
+	MAP_LAND:       color.RGBA{70, 84, 110, 255},
+	MAP_BUBBLE:     color.RGBA{230, 70, 40, 255},
+	MAP_CAPTION:    color.RGBA{255, 255, 255, 255},
+}
+
+// 3x5 glyphs for the caption, which is always in the form of
+// "2006-01-02 15:04 UTC".
+var captionGlyphs = map[rune][5]string{
+	'0': {"###", "#.#", "#.#", "#.#", "###"},
+	'1': {".#.", "##.", ".#.", ".#.", "###"},
+	'2': {"###", "..#", "###", "#..", "###"},
+	'3': {"###", "..#", "###", "..#", "###"},
+	'4': {"#.#", "#.#", "###", "..#", "..#"},
+	'5': {"###", "#..", "###", "..#", "###"},
+	'6': {"###", "#..", "###", "#.#", "###"},
+	'7': {"###", "..#", "..#", "..#", "..#"},
+	'8': {"###", "#.#", "###", "#.#", "###"},
+	'9': {"###", "#.#", "###", "..#", "###"},
+	'-': {"...", "...", "###", "...", "..."},
+	':': {"...", ".#.", "...", ".#.", "..."},
+	' ': {"...", "...", "...", "...", "..."},
+	'U': {"#.#", "#.#", "#.#", "#.#", "###"},
+	'T': {"###", ".#.", ".#.", ".#.", ".#."},
+	'C': {"###", "#..", "#..", "#..", "###"},
+}
+
+const CAPTION_LAYOUT = "2006-01-02 15:04 UTC"
+
+// MapRenderer draws one world map frame per time bucket of a TimeSeries,
+// with a bubble per location sized by its count.  The land is drawn from
+// the coordinates of every block in the database, in the equirectangular
+// projection.
+//
+// The output format is chosen by the extension of Output: ".gif" writes
+// a single animated GIF; ".png" and ".svg" write one file per frame,
+// numbered either by a single %d or %0Nd verb in Output (e.g.
+// "frame-%04d.png"), or by a sequence number appended to the base name.
+type MapRenderer struct {
+	Output string
+	Width  int
+	Height int
+	Delay  int // delay between GIF frames, in 1/100 seconds
+
+	base    *image.Paletted
+	basePNG string
+}
+
+type MapRequest struct {
+	Renderer *MapRenderer
+	Done     chan struct{}
+}
+
+func NewMapRenderer(db geoip.Database, output string, width int, delay int) (*MapRenderer, error) {
+	switch strings.ToLower(filepath.Ext(output)) {
+	case ".gif", ".png", ".svg":
+	default:
+		return nil, fmt.Errorf("unknown map format: %v", output)
+	}
+	if len(frameVerb.FindAllString(output, -1)) > 1 {
+		return nil, fmt.Errorf("more than one frame number in %v", output)
+	}
+	if width < 64 {
+		return nil, fmt.Errorf("map width %v is too small", width)
+	}
+
+	m := &MapRenderer{Output: output, Width: width, Height: width / 2, Delay: delay}
+	m.base = image.NewPaletted(image.Rect(0, 0, m.Width, m.Height), mapPalette)
+	db.Walk(func(loc geoip.Location) bool {
+		x, y := m.project(loc.Latitude, loc.Longitude)
+		m.base.SetColorIndex(x, y, MAP_LAND)
+		return true
+	})
+	return m, nil
+}
+
+// project returns the pixel of the coordinates; the longitude 180 and the
+// latitude -90 are on the last column and row.
+func (m *MapRenderer) project(lat, lon float32) (int, int) {
+	x := int((float64(lon) + 180) / 360 * float64(m.Width))
+	y := int((90 - float64(lat)) / 180 * float64(m.Height))
+	return min(x, m.Width-1), min(y, m.Height-1)
+}
+
+func (m *MapRenderer) maxRadius() float64 {
+	return float64(m.Width) / 40
+}
+
+func (m *MapRenderer) radius(count, maxCount int) float64 {
+	r := m.maxRadius() * math.Sqrt(float64(count)/float64(maxCount))
+	return math.Max(r, 1.5)
+}
+
+func (m *MapRenderer) captionScale() int {
+	if s := m.Width / 300; s > 1 {
+		return s
+	}
+	return 1
+}
+
+// Render writes one frame per bucket from the first bucket to the last
+// one, including the empty buckets in between.  The bubbles are scaled
+// by the largest count over all frames, so frames can be compared.
+func (m *MapRenderer) Render(ts *TimeSeries) error {
+	times := ts.Times()
+	if len(times) == 0 {
+		return fmt.Errorf("no data to draw")
+	}
+	step := int64(ts.Bucket / time.Second)
+	if step <= 0 {
+		return fmt.Errorf("bucket size %v is too small", ts.Bucket)
+	}
+	first, last := times[0], times[len(times)-1]
+	nframes := (last-first)/step + 1
+	if nframes > MAX_MAP_FRAMES {
+		return fmt.Errorf("too many frames (%v), use a larger bucket", nframes)
+	}
+	gifOutput := strings.ToLower(filepath.Ext(m.Output)) == ".gif"
+	if gifOutput && nframes*int64(m.Width*m.Height) > MAX_MAP_GIF_PIXELS {
+		return fmt.Errorf("too many frames (%v) of %vx%v for a GIF, use a larger bucket or a smaller width", nframes, m.Width, m.Height)
+	}
+
+	maxCount := 1
+	for _, bucket := range ts.Buckets {
+		for _, e := range bucket {
+			if !e.IsCategory() && e.Count > maxCount {
+				maxCount = e.Count
+			}
+		}
+	}
+	log.Printf("rendering %v frames to %v", nframes, m.Output)
+
+	anim := &gif.GIF{}
+	for i := int64(0); i < nframes; i++ {
+		start := first + i*step
+		entries := ts.BucketEntries(start)
+		caption := time.Unix(start, 0).UTC().Format(CAPTION_LAYOUT)
+
+		var err error
+		switch strings.ToLower(filepath.Ext(m.Output)) {
+		case ".gif":
+			anim.Image = append(anim.Image, m.drawFrame(entries, maxCount, caption))
+			anim.Delay = append(anim.Delay, m.Delay)
+		case ".png":
+			err = m.writeFrame(int(i), func(w io.Writer) error {
+				return png.Encode(w, m.drawFrame(entries, maxCount, caption))
+			})
+		case ".svg":
+			err = m.writeFrame(int(i), func(w io.Writer) error {
+				return m.writeSVG(w, entries, maxCount, caption)
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(anim.Image) > 0 {
+		return m.writeFile(m.Output, func(w io.Writer) error {
+			return gif.EncodeAll(w, anim)
+		})
+	}
+	return nil
+}
+
+func (m *MapRenderer) frameName(index int) string {
+	if loc := frameVerb.FindStringIndex(m.Output); loc != nil {
+		return m.Output[:loc[0]] + fmt.Sprintf(m.Output[loc[0]:loc[1]], index) + m.Output[loc[1]:]
+	}
+	ext := filepath.Ext(m.Output)
+	return fmt.Sprintf("%s-%04d%s", strings.TrimSuffix(m.Output, ext), index, ext)
+}
+
+func (m *MapRenderer) writeFrame(index int, encode func(w io.Writer) error) error {
+	return m.writeFile(m.frameName(index), encode)
+}
+
+func (m *MapRenderer) writeFile(filename string, encode func(w io.Writer) error) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := encode(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (m *MapRenderer) drawFrame(entries []PopulationEntry, maxCount int, caption string) *image.Paletted {
+	img := image.NewPaletted(m.base.Rect, mapPalette)
+	copy(img.Pix, m.base.Pix)
+
+	// draw the smaller bubbles last, so they remain visible; the
+	// special-purpose addresses have no location
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].IsCategory() {
+			continue
+		}
+		x, y := m.project(entries[i].Latitude, entries[i].Longitude)
+		fillCircle(img, x, y, m.radius(entries[i].Count, maxCount), MAP_BUBBLE)
+	}
+	drawCaption(img, caption, m.captionScale())
+	return img
+}
+
+func fillCircle(img *image.Paletted, cx, cy int, r float64, index uint8) {
+	ir := int(math.Ceil(r))
+	for y := cy - ir; y <= cy+ir; y++ {
+		for x := cx - ir; x <= cx+ir; x++ {
+			dx, dy := float64(x-cx), float64(y-cy)
+			if dx*dx+dy*dy <= r*r {
+				img.SetColorIndex(x, y, index)
+			}
+		}
+	}
+}
+
+func drawCaption(img *image.Paletted, caption string, scale int) {
+	x0 := 2 * scale
+	y0 := img.Rect.Dy() - 7*scale
+
+	for i, ch := range caption {
+		glyph, ok := captionGlyphs[ch]
+		if !ok {
+			continue
+		}
+		for gy, row := range glyph {
+			for gx, pixel := range row {
+				if pixel != '#' {
+					continue
+				}
+				for sy := 0; sy < scale; sy++ {
+					for sx := 0; sx < scale; sx++ {
+						img.SetColorIndex(x0+(i*4+gx)*scale+sx, y0+gy*scale+sy, MAP_CAPTION)
+					}
+				}
+			}
+		}
+	}
+}
+
+func svgColor(index uint8) string {
+	r, g, b, _ := mapPalette[index].RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+func (m *MapRenderer) writeSVG(w io.Writer, entries []PopulationEntry, maxCount int, caption string) error {
+	if m.basePNG == "" {
+		var base bytes.Buffer
+		if err := png.Encode(&base, m.base); err != nil {
+			return err
+		}
+		m.basePNG = base64.StdEncoding.EncodeToString(base.Bytes())
+	}
+
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\">\n", m.Width, m.Height)
+	fmt.Fprintf(w, "<image width=\"%d\" height=\"%d\" href=\"data:image/png;base64,%s\"/>\n",
+		m.Width, m.Height, m.basePNG)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].IsCategory() {
+			continue
+		}
+		x, y := m.project(entries[i].Latitude, entries[i].Longitude)
+		fmt.Fprintf(w, "<circle cx=\"%d\" cy=\"%d\" r=\"%.1f\" fill=\"%s\" fill-opacity=\"0.7\"><title>%s: %d</title></circle>\n",
+			x, y, m.radius(entries[i].Count, maxCount), svgColor(MAP_BUBBLE), svgEscape(entries[i].Name), entries[i].Count)
+	}
+	fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" fill=\"%s\" font-family=\"monospace\" font-size=\"%d\">%s</text>\n",
+		2*m.captionScale(), m.Height-2*m.captionScale(), svgColor(MAP_CAPTION), 7*m.captionScale(), caption)
+	_, err := fmt.Fprintf(w, "</svg>\n")
+	return err
+}
+
+func svgEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;").Replace(s)
+}
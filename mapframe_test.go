@@ -0,0 +1,185 @@
+package main
+
+import (
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+func TestMapRenderer_Project(t *testing.T) {
+	m := &MapRenderer{Width: 360, Height: 180}
+	tests := []struct {
+		lat, lon float32
+		x, y     int
+	}{
+		{0, 0, 180, 90},
+		{90, -180, 0, 0},
+		{-90, 180, 359, 179},
+		{35.5, 139.5, 319, 54},
+		{-33.9, -70.7, 109, 123},
+	}
+	for _, test := range tests {
+		if x, y := m.project(test.lat, test.lon); x != test.x || y != test.y {
+			t.Errorf("%v, %v: expected (%v, %v), got (%v, %v)", test.lat, test.lon, test.x, test.y, x, y)
+		}
+	}
+}
+
+func TestMapRenderer_FrameName(t *testing.T) {
+	tests := []struct {
+		output   string
+		index    int
+		expected string
+	}{
+		{"map.png", 0, "map-0000.png"},
+		{"out/map.svg", 12, "out/map-0012.svg"},
+		{"frames/%04d.png", 3, "frames/0003.png"},
+		{"frame-%d.svg", 10000, "frame-10000.svg"},
+		{"100%.png", 1, "100%-0001.png"},
+		{"100%/%03d-%s.svg", 7, "100%/007-%s.svg"},
+	}
+	for _, test := range tests {
+		m := &MapRenderer{Output: test.output}
+		if name := m.frameName(test.index); name != test.expected {
+			t.Errorf("%v, %v: expected %v, got %v", test.output, test.index, test.expected, name)
+		}
+	}
+}
+
+// testMapSeries has a location in the first and the last of four buckets
+// of a minute, and a special-purpose address in the first one.
+func testMapSeries() *TimeSeries {
+	base := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	ts := NewTimeSeries(time.Minute)
+	ts.Add("JP: Tokyo", 35.5, 139.5, base)
+	ts.Add(geoip.CATEGORY_PRIVATE, 0, 0, base)
+	ts.Add(geoip.CATEGORY_PRIVATE, 0, 0, base)
+	ts.Add("JP: Tokyo", 35.5, 139.5, base.Add(3*time.Minute))
+	return ts
+}
+
+func newTestMapRenderer(t *testing.T, output string) *MapRenderer {
+	t.Helper()
+	m, err := NewMapRenderer(newTestBlockDatabase(10, 2), output, 360, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMapRenderer_GIF(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "map.gif")
+	if err := newTestMapRenderer(t, output).Render(testMapSeries()); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	anim, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the empty buckets in between are included
+	if len(anim.Image) != 4 || !reflect.DeepEqual(anim.Delay, []int{20, 20, 20, 20}) {
+		t.Fatalf("%v frames with delays %v, expected 4", len(anim.Image), anim.Delay)
+	}
+	for i, img := range anim.Image {
+		tokyo := img.ColorIndexAt(319, 54) == MAP_BUBBLE
+		if tokyo != (i == 0 || i == 3) {
+			t.Errorf("frame %v: bubble of Tokyo %v", i, tokyo)
+		}
+		if img.ColorIndexAt(180, 90) == MAP_BUBBLE {
+			t.Errorf("frame %v: special-purpose addresses drawn at (0, 0)", i)
+		}
+	}
+}
+
+func TestMapRenderer_Frames(t *testing.T) {
+	dir := t.TempDir()
+	if err := newTestMapRenderer(t, filepath.Join(dir, "map.png")).Render(testMapSeries()); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestMapRenderer(t, filepath.Join(dir, "frame%02d.svg")).Render(testMapSeries()); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	expected := []string{
+		"frame00.svg", "frame01.svg", "frame02.svg", "frame03.svg",
+		"map-0000.png", "map-0001.png", "map-0002.png", "map-0003.png",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected files %v, got %v", expected, names)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "map-0000.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if img, err := png.Decode(f); err != nil {
+		t.Error(err)
+	} else if b := img.Bounds(); b.Dx() != 360 || b.Dy() != 180 {
+		t.Errorf("unexpected size: %v", b)
+	}
+
+	svg, err := os.ReadFile(filepath.Join(dir, "frame00.svg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(svg), "<circle"); n != 1 || !strings.Contains(string(svg), "JP: Tokyo: 1") {
+		t.Errorf("unexpected circles (%v):\n%s", n, svg)
+	}
+}
+
+func TestMapRenderer_Errors(t *testing.T) {
+	m := newTestMapRenderer(t, filepath.Join(t.TempDir(), "map.gif"))
+	if err := m.Render(NewTimeSeries(time.Minute)); err == nil {
+		t.Errorf("no error without data")
+	}
+
+	ts := NewTimeSeries(time.Second)
+	ts.Add("JP: Tokyo", 35.5, 139.5, time.Unix(0, 0))
+	ts.Add("JP: Tokyo", 35.5, 139.5, time.Unix(MAX_MAP_FRAMES, 0))
+	if err := m.Render(ts); err == nil || !strings.Contains(err.Error(), "too many frames") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// the frames of a wide GIF do not fit in memory
+	wide, err := NewMapRenderer(newTestBlockDatabase(10, 2), filepath.Join(t.TempDir(), "map.gif"), 4096, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts = NewTimeSeries(time.Second)
+	ts.Add("JP: Tokyo", 35.5, 139.5, time.Unix(0, 0))
+	ts.Add("JP: Tokyo", 35.5, 139.5, time.Unix(MAX_MAP_FRAMES-1, 0))
+	if err := wide.Render(ts); err == nil || !strings.Contains(err.Error(), "too many frames") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, output := range []string{"map.jpg", "map", "%d-%04d.png"} {
+		if _, err := NewMapRenderer(newTestBlockDatabase(10, 2), output, 360, 20); err == nil {
+			t.Errorf("%v: no error", output)
+		}
+	}
+	if _, err := NewMapRenderer(newTestBlockDatabase(10, 2), "map.gif", 32, 20); err == nil {
+		t.Errorf("no error for a small width")
+	}
+}
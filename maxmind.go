@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const MAXMIND_DOWNLOAD_URL = "https://download.maxmind.com"
+
+// MAXMIND_DOWNLOAD_HOST is the only host of a -u url that receives the
+// MaxMind credentials.
+const MAXMIND_DOWNLOAD_HOST = "download.maxmind.com"
+
+const DEFAULT_EDITION = "GeoLite2-City-CSV"
+
+var editionPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// MaxMindCredentials authenticates the downloads from MaxMind.  The
+// account ID may be empty, in which case the legacy download URL with
+// the license key in the query is used.
+type MaxMindCredentials struct {
+	AccountID  string
+	LicenseKey string
+}
+
+// LoadMaxMindCredentials returns the credentials from the arguments if
+// given, or from the environment variables MAXMIND_ACCOUNT_ID,
+// MAXMIND_LICENSE_KEY and MAXMIND_LICENSE_KEY_FILE.  The license key is
+// read from keyFile if licenseKey is empty.
+func LoadMaxMindCredentials(accountID string, licenseKey string, keyFile string) (MaxMindCredentials, error) {
+	if accountID == "" {
+		accountID = os.Getenv("MAXMIND_ACCOUNT_ID")
+	}
+	if keyFile == "" && licenseKey == "" {
+		keyFile = os.Getenv("MAXMIND_LICENSE_KEY_FILE")
+	}
+	if licenseKey == "" && keyFile != "" {
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return MaxMindCredentials{}, fmt.Errorf("cannot read the license key file: %v", err)
+		}
+		licenseKey = strings.TrimSpace(string(b))
+		if licenseKey == "" {
+			return MaxMindCredentials{}, fmt.Errorf("license key file %v is empty", keyFile)
+		}
+	}
+	if licenseKey == "" {
+		licenseKey = os.Getenv("MAXMIND_LICENSE_KEY")
+	}
+	return MaxMindCredentials{AccountID: strings.TrimSpace(accountID), LicenseKey: licenseKey}, nil
+}
+
+// ParseEditions parses the comma separated list of MaxMind edition IDs,
+// e.g. "GeoLite2-City-CSV,GeoLite2-ASN-CSV".
+func ParseEditions(s string) ([]string, error) {
+	editions := make([]string, 0)
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !editionPattern.MatchString(e) {
+			return nil, fmt.Errorf("invalid edition ID: %v", e)
+		}
+		editions = append(editions, e)
+	}
+	if len(editions) == 0 {
+		return nil, fmt.Errorf("no edition given")
+	}
+	return editions, nil
+}
+
+// editionSuffix returns the archive format of the edition: zip for the
+// CSV editions, and tar.gz for the MMDB editions.
+func editionSuffix(edition string) string {
+	if strings.HasSuffix(edition, "-CSV") {
+		return "zip"
+	}
+	return "tar.gz"
+}
+
+// MaxMindURL returns the download permalink of the edition.  With an
+// account ID, the credentials are sent by HTTP basic authentication (see
+// Downloader); otherwise the license key is embedded in the URL.
+func MaxMindURL(base string, edition string, cred MaxMindCredentials) string {
+	base = strings.TrimSuffix(base, "/")
+	suffix := editionSuffix(edition)
+	if cred.AccountID != "" {
+		return fmt.Sprintf("%s/geoip/databases/%s/download?suffix=%s", base, url.PathEscape(edition), url.QueryEscape(suffix))
+	}
+
+	q := url.Values{}
+	q.Set("edition_id", edition)
+	q.Set("license_key", cred.LicenseKey)
+	q.Set("suffix", suffix)
+	return fmt.Sprintf("%s/app/geoip_download?%s", base, q.Encode())
+}
+
+// IsMaxMindURL reports whether rawURL is of the MaxMind download server,
+// so that the credentials may be sent with it.
+func IsMaxMindURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Scheme == "https" && strings.EqualFold(u.Hostname(), MAXMIND_DOWNLOAD_HOST)
+}
+
+// redactURL hides the license key in url, for logging.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	q := u.Query()
+	if q.Get("license_key") == "" {
+		return s
+	}
+	q.Set("license_key", "REDACTED")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
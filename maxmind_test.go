@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func zipArchive(files map[string]string) []byte {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for name, content := range files {
+		f, _ := w.Create(name)
+		f.Write([]byte(content))
+	}
+	w.Close()
+	return b.Bytes()
+}
+
+func tarGzArchive(files map[string]string) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	w := tar.NewWriter(gz)
+	for name, content := range files {
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		w.Write([]byte(content))
+	}
+	w.Close()
+	gz.Close()
+	return b.Bytes()
+}
+
+// newMaxMindServer returns a stand-in of the MaxMind download server,
+// accepting account ID 42 with license key "secret".
+func newMaxMindServer() *httptest.Server {
+	archives := map[string][]byte{
+		"GeoLite2-City-CSV": zipArchive(map[string]string{
+			"GeoLite2-City-CSV_20180102/" + GEOLITE_BLOCK_CSV_FILE: "network,geoname_id\n",
+			"GeoLite2-City-CSV_20180102/" + GEOLITE_CITY_CSV_FILE:  "geoname_id,locale_code\n",
+		}),
+		"GeoLite2-ASN": tarGzArchive(map[string]string{
+			"GeoLite2-ASN_20180102/GeoLite2-ASN.mmdb": "mmdb",
+		}),
+	}
+	archives["GeoLite2-Tampered-CSV"] = archives["GeoLite2-City-CSV"]
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /geoip/databases/{edition}/download", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "42" || pass != "secret" {
+			http.Error(w, "Invalid account ID or license key", http.StatusUnauthorized)
+			return
+		}
+		if r.PathValue("edition") == "GeoLite2-Country-CSV" {
+			w.Header().Set("Retry-After", "3600")
+			http.Error(w, "Daily limit reached", http.StatusTooManyRequests)
+			return
+		}
+		edition := r.PathValue("edition")
+		archive, ok := archives[edition]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if suffix := r.URL.Query().Get("suffix"); strings.HasSuffix(suffix, ".sha256") {
+			fmt.Fprintf(w, "%x  %s_20180102.%s\n", sha256.Sum256(archive), edition, strings.TrimSuffix(suffix, ".sha256"))
+			return
+		}
+		if edition == "GeoLite2-Tampered-CSV" {
+			archive = archive[:len(archive)-1]
+		}
+		w.Write(archive)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestMaxMindURL(t *testing.T) {
+	cred := MaxMindCredentials{AccountID: "42", LicenseKey: "secret"}
+	u := MaxMindURL("https://download.maxmind.com/", "GeoLite2-City-CSV", cred)
+	if u != "https://download.maxmind.com/geoip/databases/GeoLite2-City-CSV/download?suffix=zip" {
+		t.Errorf("unexpected url: %v", u)
+	}
+	u = MaxMindURL("https://download.maxmind.com", "GeoLite2-City", cred)
+	if !strings.HasSuffix(u, "suffix=tar.gz") {
+		t.Errorf("MMDB edition not in tar.gz: %v", u)
+	}
+
+	u = MaxMindURL("https://download.maxmind.com", "GeoLite2-City-CSV", MaxMindCredentials{LicenseKey: "secret"})
+	if !strings.Contains(u, "license_key=secret") {
+		t.Errorf("license key not in legacy url: %v", u)
+	}
+	if strings.Contains(redactURL(u), "secret") {
+		t.Errorf("license key not redacted: %v", redactURL(u))
+	}
+}
+
+func TestLoadMaxMindCredentials(t *testing.T) {
+	keyFile := path.Join(t.TempDir(), "license")
+	os.WriteFile(keyFile, []byte("from-file\n"), 0600)
+
+	t.Setenv("MAXMIND_ACCOUNT_ID", "42")
+	t.Setenv("MAXMIND_LICENSE_KEY", "from-env")
+
+	cred, err := LoadMaxMindCredentials("", "", "")
+	if err != nil || cred.AccountID != "42" || cred.LicenseKey != "from-env" {
+		t.Errorf("credentials from environment: %+v, %v", cred, err)
+	}
+	cred, err = LoadMaxMindCredentials("", "", keyFile)
+	if err != nil || cred.LicenseKey != "from-file" {
+		t.Errorf("credentials from file: %+v, %v", cred, err)
+	}
+	cred, err = LoadMaxMindCredentials("7", "from-flag", keyFile)
+	if err != nil || cred.AccountID != "7" || cred.LicenseKey != "from-flag" {
+		t.Errorf("credentials from flags: %+v, %v", cred, err)
+	}
+}
+
+func TestDatabaseURLs_Mirror(t *testing.T) {
+	var authorized []string
+	archive := zipArchive(map[string]string{"GeoLite2-City-CSV_20180102/" + GEOLITE_BLOCK_CSV_FILE: "network,geoname_id\n"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			authorized = append(authorized, r.URL.Path)
+		}
+		if strings.HasSuffix(r.URL.Path, ".sha256") {
+			fmt.Fprintf(w, "%x  GeoLite2-City-CSV.zip\n", sha256.Sum256(archive))
+			return
+		}
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	t.Setenv("MAXMIND_ACCOUNT_ID", "42")
+	t.Setenv("MAXMIND_LICENSE_KEY", "secret")
+	defer func(u string) { dbURL = u }(dbURL)
+
+	dbURL = server.URL + "/GeoLite2-City-CSV.zip"
+	urls, cred, err := databaseURLs()
+	if err != nil || cred != (MaxMindCredentials{}) {
+		t.Fatalf("credentials of a mirror: %+v, %v", cred, err)
+	}
+	d := Downloader{Username: cred.AccountID, Password: cred.LicenseKey, VerifyChecksum: true, WorkDir: t.TempDir()}
+	defer d.Close()
+	if err := d.Download(urls); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if len(authorized) > 0 {
+		t.Errorf("credentials sent to the mirror: %v", authorized)
+	}
+
+	dbURL = "https://download.maxmind.com/geoip/databases/GeoLite2-City-CSV/download?suffix=zip"
+	if _, cred, err := databaseURLs(); err != nil || cred.AccountID != "42" || cred.LicenseKey != "secret" {
+		t.Errorf("credentials of MaxMind: %+v, %v", cred, err)
+	}
+}
+
+func TestDownloader_MaxMindEditions(t *testing.T) {
+	server := newMaxMindServer()
+	defer server.Close()
+
+	cred := MaxMindCredentials{AccountID: "42", LicenseKey: "secret"}
+	d := Downloader{Username: cred.AccountID, Password: cred.LicenseKey, VerifyChecksum: true}
+	defer d.Close()
+
+	urls := []string{
+		MaxMindURL(server.URL, "GeoLite2-City-CSV", cred),
+		MaxMindURL(server.URL, "GeoLite2-ASN", cred),
+	}
+	if err := d.Download(urls); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	for _, name := range []string{GEOLITE_BLOCK_CSV_FILE, GEOLITE_CITY_CSV_FILE, "GeoLite2-ASN.mmdb"} {
+		if _, err := os.Stat(path.Join(d.Base, name)); err != nil {
+			t.Errorf("%v not unpacked: %v", name, err)
+		}
+	}
+	if d.Release != "GeoLite2-City-CSV_20180102" {
+		t.Errorf("unexpected release: %v", d.Release)
+	}
+}
+
+func TestDownloader_MaxMindErrors(t *testing.T) {
+	server := newMaxMindServer()
+	defer server.Close()
+
+	cases := []struct {
+		edition  string
+		password string
+		message  string
+	}{
+		{"GeoLite2-City-CSV", "wrong", "license key"},
+		{"GeoLite2-Country-CSV", "secret", "retry after 3600"},
+		{"GeoLite2-Nothing-CSV", "secret", "edition ID"},
+	}
+	for _, c := range cases {
+		d := Downloader{Username: "42", Password: c.password}
+		err := d.Fetch(MaxMindURL(server.URL, c.edition, MaxMindCredentials{AccountID: "42"}))
+		d.Close()
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%v: expected error with %q, got %v", c.edition, c.message, err)
+		}
+	}
+}
+
+func TestDownloader_Checksum(t *testing.T) {
+	server := newMaxMindServer()
+	defer server.Close()
+
+	cred := MaxMindCredentials{AccountID: "42", LicenseKey: "secret"}
+	d := Downloader{Username: cred.AccountID, Password: cred.LicenseKey, VerifyChecksum: true}
+	defer d.Close()
+	err := d.Fetch(MaxMindURL(server.URL, "GeoLite2-Tampered-CSV", cred))
+	if _, ok := err.(*ChecksumMismatchError); !ok {
+		t.Fatalf("tampered archive not detected: %v", err)
+	}
+	if d.Archive != "" {
+		t.Errorf("tampered archive kept: %v", d.Archive)
+	}
+
+	d.Checksum = strings.Repeat("0", 64)
+	err = d.Fetch(MaxMindURL(server.URL, "GeoLite2-City-CSV", cred))
+	if _, ok := err.(*ChecksumMismatchError); !ok {
+		t.Errorf("expected digest not used: %v", err)
+	}
+}
+
+func TestDownloader_UnpackCorruptedZip(t *testing.T) {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	fw, _ := w.CreateHeader(&zip.FileHeader{Name: "GeoLite2-City-CSV_20180102/" + GEOLITE_BLOCK_CSV_FILE, Method: zip.Store})
+	fw.Write([]byte("network,geoname_id\n1.1.1.0/24,1\n"))
+	w.Close()
+	archive := b.Bytes()
+	archive[bytes.Index(archive, []byte("1.1.1.0"))] = '9'
+
+	f, err := os.CreateTemp(t.TempDir(), "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(archive)
+	f.Close()
+
+	d := Downloader{Archive: f.Name()}
+	defer d.Close()
+	if err := d.Unpack(); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("corrupted zip unpacked: %v", err)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"strings"
+
+	"github.com/cinsk/goip/geoip"
 )
 
 type PopulationField int
@@ -23,6 +25,12 @@ type PopulationEntry struct {
 	Group     int
 }
 
+// IsCategory reports whether the entry counts the special-purpose
+// addresses of a category, which have no location.
+func (e PopulationEntry) IsCategory() bool {
+	return geoip.IsCategory(e.Name)
+}
+
 type ByPopulation []PopulationEntry
 
 func (p ByPopulation) Len() int           { return len(p) }
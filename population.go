@@ -0,0 +1,209 @@
+package main
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+const POPULATION_BUCKET_DURATION = time.Minute
+
+// POPULATION_HISTORY is the longest window that can be asked for a
+// windowed statistic; older buckets are recycled.
+const POPULATION_HISTORY = 24 * time.Hour
+
+type populationBucket struct {
+	minute  int64
+	entries map[string]PopulationEntry
+}
+
+// Population counts the occurrences of each location, both in total and
+// in a ring of per-minute buckets, so that the statistic can be limited
+// to the recent activity.
+type Population struct {
+	Total map[string]PopulationEntry
+
+	buckets []populationBucket
+	latest  int64
+}
+
+func NewPopulation() *Population {
+	p := &Population{}
+	p.Reset()
+	return p
+}
+
+func (p *Population) Reset() {
+	p.Total = make(map[string]PopulationEntry)
+	p.buckets = make([]populationBucket, POPULATION_HISTORY/POPULATION_BUCKET_DURATION)
+	p.latest = 0
+}
+
+// minuteOf returns the number of the bucket of t, negative before 1970.
+func minuteOf(t time.Time) int64 {
+	sec, d := t.Unix(), int64(POPULATION_BUCKET_DURATION/time.Second)
+	if sec < 0 {
+		return (sec - d + 1) / d
+	}
+	return sec / d
+}
+
+func addPopulation(m map[string]PopulationEntry, key string, lat, lon float32, count int) {
+	if ent, ok := m[key]; ok {
+		ent.Count += count
+		m[key] = ent
+	} else {
+		m[key] = PopulationEntry{Name: key, Count: count, Latitude: lat, Longitude: lon}
+	}
+}
+
+// Add counts one occurrence of the location key at time t.  Occurrences
+// older than POPULATION_HISTORY before the latest one, or before 1970, are
+// only counted in the total.
+func (p *Population) Add(key string, lat, lon float32, t time.Time) {
+	addPopulation(p.Total, key, lat, lon, 1)
+
+	minute := minuteOf(t)
+	if minute < 0 {
+		return
+	}
+	if minute > p.latest {
+		p.latest = minute
+	}
+	if p.latest-minute >= int64(len(p.buckets)) {
+		return
+	}
+
+	b := &p.buckets[minute%int64(len(p.buckets))]
+	if b.entries == nil || b.minute != minute {
+		b.minute = minute
+		b.entries = make(map[string]PopulationEntry)
+	}
+	addPopulation(b.entries, key, lat, lon, 1)
+}
+
+// Latest returns the time of the newest bucket.
+func (p *Population) Latest() time.Time {
+	return time.Unix(p.latest*int64(POPULATION_BUCKET_DURATION/time.Second), 0)
+}
+
+// Entries returns the population entries counted within the window ending
+// at until.  If until is zero, the window ends at the latest occurrence.
+// If window is zero, all occurrences are returned.
+func (p *Population) Entries(window time.Duration, until time.Time) []PopulationEntry {
+	if window <= 0 {
+		entries := make([]PopulationEntry, 0, len(p.Total))
+		for _, v := range p.Total {
+			entries = append(entries, v)
+		}
+		return entries
+	}
+
+	last := p.latest
+	if !until.IsZero() {
+		last = minuteOf(until)
+	}
+	n := int64((window + POPULATION_BUCKET_DURATION - 1) / POPULATION_BUCKET_DURATION)
+	if n > int64(len(p.buckets)) {
+		n = int64(len(p.buckets))
+	}
+
+	merged := make(map[string]PopulationEntry)
+	for minute := last - n + 1; minute <= last; minute++ {
+		if minute < 0 {
+			continue
+		}
+		b := &p.buckets[minute%int64(len(p.buckets))]
+		if b.entries == nil || b.minute != minute {
+			continue
+		}
+		for k, v := range b.entries {
+			addPopulation(merged, k, v.Latitude, v.Longitude, v.Count)
+		}
+	}
+
+	entries := make([]PopulationEntry, 0, len(merged))
+	for _, v := range merged {
+		entries = append(entries, v)
+	}
+	return entries
+}
+
+const POPULATION_SHARDS = 64
+
+type populationShard struct {
+	sync.Mutex
+	*Population
+}
+
+// ShardedPopulation is a Population safe for concurrent use.  The
+// locations are spread over lock-striped shards by their keys, so that
+// concurrent lookups rarely wait for each other.
+type ShardedPopulation struct {
+	shards [POPULATION_SHARDS]populationShard
+	seed   maphash.Seed
+}
+
+func NewShardedPopulation() *ShardedPopulation {
+	p := &ShardedPopulation{seed: maphash.MakeSeed()}
+	for i := range p.shards {
+		p.shards[i].Population = NewPopulation()
+	}
+	return p
+}
+
+func (p *ShardedPopulation) Add(key string, lat, lon float32, t time.Time) {
+	shard := &p.shards[maphash.String(p.seed, key)%POPULATION_SHARDS]
+	shard.Lock()
+	shard.Add(key, lat, lon, t)
+	shard.Unlock()
+}
+
+func (p *ShardedPopulation) Reset() {
+	for i := range p.shards {
+		p.shards[i].Lock()
+		p.shards[i].Reset()
+		p.shards[i].Unlock()
+	}
+}
+
+func (p *ShardedPopulation) Latest() time.Time {
+	var latest time.Time
+	for i := range p.shards {
+		p.shards[i].Lock()
+		if t := p.shards[i].Latest(); t.After(latest) {
+			latest = t
+		}
+		p.shards[i].Unlock()
+	}
+	return latest
+}
+
+// Entries is the same as Population.Entries over all shards.  Every shard
+// is locked while the entries are copied, so they are a consistent
+// snapshot of the population.  Since a location belongs to exactly one
+// shard, the entries need no merge.
+func (p *ShardedPopulation) Entries(window time.Duration, until time.Time) []PopulationEntry {
+	for i := range p.shards {
+		p.shards[i].Lock()
+	}
+	defer func() {
+		for i := range p.shards {
+			p.shards[i].Unlock()
+		}
+	}()
+
+	if window > 0 && until.IsZero() {
+		for i := range p.shards {
+			if t := p.shards[i].Latest(); t.After(until) {
+				until = t
+			}
+		}
+	}
+
+	var entries []PopulationEntry
+	for i := range p.shards {
+		entries = append(entries, p.shards[i].Entries(window, until)...)
+	}
+	return entries
+}
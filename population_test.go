@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testPopulation interface {
+	Add(key string, lat, lon float32, t time.Time)
+	Entries(window time.Duration, until time.Time) []PopulationEntry
+}
+
+func populationCounts(entries []PopulationEntry) map[string]int {
+	counts := map[string]int{}
+	for _, e := range entries {
+		counts[e.Name] += e.Count
+	}
+	return counts
+}
+
+var testPopulationBase = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+func TestPopulation_Window(t *testing.T) {
+	base := testPopulationBase
+	tests := []struct {
+		window   time.Duration
+		until    time.Time
+		expected map[string]int
+	}{
+		{0, time.Time{}, map[string]int{"A": 2, "B": 1, "C": 1}},
+		{time.Minute, time.Time{}, map[string]int{"A": 1}},
+		{90 * time.Second, time.Time{}, map[string]int{"A": 2}},
+		{5 * time.Minute, time.Time{}, map[string]int{"A": 2}},
+		{6 * time.Minute, time.Time{}, map[string]int{"A": 2, "B": 1}},
+		{11 * time.Minute, time.Time{}, map[string]int{"A": 2, "B": 1}},
+		{12 * time.Minute, time.Time{}, map[string]int{"A": 2, "B": 1, "C": 1}},
+		{48 * time.Hour, time.Time{}, map[string]int{"A": 2, "B": 1, "C": 1}},
+		{time.Minute, base.Add(-5 * time.Minute), map[string]int{"B": 1}},
+		{time.Minute, base.Add(-4*time.Minute - time.Second), map[string]int{"B": 1}},
+		{2 * time.Minute, base.Add(-4 * time.Minute), map[string]int{"B": 1}},
+		{time.Hour, base.Add(time.Hour), map[string]int{}},
+		{time.Hour, base.Add(time.Hour - time.Minute), map[string]int{"A": 1}},
+	}
+	for _, p := range []testPopulation{NewPopulation(), NewShardedPopulation()} {
+		p.Add("C", 0, 0, base.Add(-10*time.Minute-30*time.Second))
+		p.Add("B", 0, 0, base.Add(-5*time.Minute))
+		p.Add("A", 0, 0, base.Add(-time.Minute))
+		p.Add("A", 0, 0, base)
+
+		for _, test := range tests {
+			counts := populationCounts(p.Entries(test.window, test.until))
+			if !reflect.DeepEqual(counts, test.expected) {
+				t.Errorf("%T, window %v until %v: expected %v, got %v", p, test.window, test.until, test.expected, counts)
+			}
+		}
+	}
+}
+
+func TestPopulation_WrapAround(t *testing.T) {
+	base := testPopulationBase
+	tests := []struct {
+		window   time.Duration
+		expected map[string]int
+	}{
+		{0, map[string]int{"A": 1, "B": 1, "C": 1, "D": 1}},
+		{time.Minute, map[string]int{"B": 1}},
+		{POPULATION_HISTORY, map[string]int{"B": 1, "D": 1}},
+		{2 * POPULATION_HISTORY, map[string]int{"B": 1, "D": 1}},
+	}
+	for _, p := range []testPopulation{NewPopulation(), NewShardedPopulation()} {
+		p.Add("A", 0, 0, base)
+		p.Add("D", 0, 0, base.Add(time.Minute))
+		// the bucket of A is reused
+		p.Add("B", 0, 0, base.Add(POPULATION_HISTORY))
+		// too old for a bucket, only counted in the total
+		p.Add("C", 0, 0, base)
+
+		for _, test := range tests {
+			counts := populationCounts(p.Entries(test.window, time.Time{}))
+			if !reflect.DeepEqual(counts, test.expected) {
+				t.Errorf("%T, window %v: expected %v, got %v", p, test.window, test.expected, counts)
+			}
+		}
+	}
+}
+
+func TestPopulation_BeforeEpoch(t *testing.T) {
+	for _, p := range []testPopulation{NewPopulation(), NewShardedPopulation()} {
+		p.Add("A", 0, 0, time.Date(1969, 12, 31, 23, 59, 30, 0, time.UTC))
+		p.Add("A", 0, 0, time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC))
+		p.Add("B", 0, 0, time.Unix(0, 0))
+
+		// only counted in the total
+		if counts := populationCounts(p.Entries(0, time.Time{})); !reflect.DeepEqual(counts, map[string]int{"A": 2, "B": 1}) {
+			t.Errorf("%T: unexpected total %v", p, counts)
+		}
+		if counts := populationCounts(p.Entries(POPULATION_HISTORY, time.Unix(0, 0))); !reflect.DeepEqual(counts, map[string]int{"B": 1}) {
+			t.Errorf("%T: unexpected window %v", p, counts)
+		}
+	}
+}
+
+func TestPopulation_Reset(t *testing.T) {
+	p := NewPopulation()
+	p.Add("A", 1, 2, testPopulationBase)
+	if e := p.Entries(time.Minute, time.Time{}); len(e) != 1 || e[0].Latitude != 1 || e[0].Longitude != 2 {
+		t.Errorf("unexpected entries: %v", e)
+	}
+	p.Reset()
+	if e := p.Entries(0, time.Time{}); len(e) != 0 {
+		t.Errorf("entries after reset: %v", e)
+	}
+	if e := p.Entries(time.Minute, testPopulationBase); len(e) != 0 {
+		t.Errorf("entries after reset: %v", e)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Interval of the progress updates, on a terminal and otherwise.
+const PROGRESS_INTERVAL = 500 * time.Millisecond
+const PROGRESS_LOG_INTERVAL = 10 * time.Second
+
+// Progress reports the bytes written to it, e.g. a download, as
+// "NAME: 12.3MB / 45.6MB (1.2MB/s)".  On a terminal the line is updated
+// in place; otherwise a line is printed every PROGRESS_LOG_INTERVAL.
+type Progress struct {
+	Out   io.Writer
+	Label string
+	Total int64 // -1 if unknown
+	Done  int64
+
+	start    time.Time
+	last     time.Time
+	resumed  int64
+	terminal bool
+}
+
+// NewProgress starts reporting a transfer of total bytes, of which done
+// were already transferred before (e.g. a resumed download).
+func NewProgress(out io.Writer, label string, done int64, total int64) *Progress {
+	p := &Progress{Out: out, Label: label, Total: total, Done: done, resumed: done, start: time.Now()}
+	p.last = p.start
+	if f, ok := out.(*os.File); ok {
+		p.terminal = isTerminal(f)
+	}
+	return p
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *Progress) Write(b []byte) (int, error) {
+	p.Done += int64(len(b))
+	interval := PROGRESS_LOG_INTERVAL
+	if p.terminal {
+		interval = PROGRESS_INTERVAL
+	}
+	if now := time.Now(); now.Sub(p.last) >= interval {
+		p.last = now
+		p.print()
+	}
+	return len(b), nil
+}
+
+func (p *Progress) print() {
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.Done-p.resumed) / elapsed
+	}
+	total := "?"
+	if p.Total >= 0 {
+		total = formatBytes(p.Total)
+	}
+	line := fmt.Sprintf("%v: %v / %v (%v/s)", p.Label, formatBytes(p.Done), total, formatBytes(int64(rate)))
+	if p.terminal {
+		fmt.Fprintf(p.Out, "\r%-70s", line)
+	} else {
+		fmt.Fprintln(p.Out, line)
+	}
+}
+
+// Finish prints the final state; it ends the line on a terminal.
+func (p *Progress) Finish() {
+	p.print()
+	if p.terminal {
+		fmt.Fprintln(p.Out)
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+// Reloader builds a new database while the current one keeps serving the
+// lookups, then swaps DB to the new one.  The lookups in flight keep
+// using the database they started with.
+type Reloader struct {
+	DB      *geoip.Handle
+	Backend string // geoip.BACKEND_MAXMIND_CSV if empty
+	Options geoip.Options
+
+	// Directory to reload from; if empty, the database is downloaded
+	// from URLs again.
+	Directory string
+	URLs      []string
+	NoCleanUp bool
+
+	// Settings of the downloads (credentials, checksum, HTTP client, ...);
+	// copied for each download.
+	Downloader Downloader
+
+	// If Cache is set, the downloaded database is kept in it as Source.
+	// In Offline mode, the newest cached database is reloaded instead.
+	Cache   *DatabaseCache
+	Source  string
+	Offline bool
+
+	// OverrideFile, if set, is loaded again with every reload, and its
+	// overrides take precedence over the database.
+	OverrideFile string
+
+	// ETag and LastModified of the last downloaded archive, used by
+	// Update to download only a changed archive.
+	ETag         string
+	LastModified string
+
+	cacheDir string // cached version in DB, if any
+	lock     sync.Mutex
+}
+
+// Reload loads the database from dir, or from the default source if dir
+// is empty, and swaps DB to it.  Only one reload runs at a time.
+func (r *Reloader) Reload(dir string) (geoip.Info, error) {
+	return r.reload(dir, false)
+}
+
+// Update downloads the archives from URLs if the first one changed since the last
+// download, and reloads the database from it.  It returns ErrNotModified
+// if the archive did not change.
+func (r *Reloader) Update() (geoip.Info, error) {
+	return r.reload("", true)
+}
+
+func (r *Reloader) reload(dir string, conditional bool) (geoip.Info, error) {
+	if !r.lock.TryLock() {
+		return geoip.Info{}, fmt.Errorf("reload already in progress")
+	}
+	defer r.lock.Unlock()
+
+	if dir == "" && !conditional {
+		dir = r.Directory
+	}
+	release, cacheDir := "", ""
+	downloader := r.Downloader
+	switch {
+	case dir != "":
+	case r.Offline:
+		entry, err := r.Cache.Latest(r.Source)
+		if err != nil {
+			return geoip.Info{}, err
+		}
+		dir, release, cacheDir = entry.Dir, entry.Release, entry.Dir
+	case r.Cache != nil:
+		if !r.NoCleanUp {
+			defer downloader.Close()
+		}
+		entry, err := r.Cache.Get(&downloader, r.URLs, r.Source, 0)
+		if err == ErrNotModified && conditional {
+			return geoip.Info{}, err
+		}
+		if err != nil && err != ErrNotModified {
+			return geoip.Info{}, fmt.Errorf("cannot download the database: %v", err)
+		}
+		if conditional && entry.Dir == r.cacheDir {
+			// the download failed, and the cached version is in use
+			return geoip.Info{}, ErrNotModified
+		}
+		dir, release, cacheDir = entry.Dir, entry.Release, entry.Dir
+	default:
+		if conditional {
+			downloader.ETag = r.ETag
+			downloader.LastModified = r.LastModified
+		}
+		if !r.NoCleanUp {
+			defer downloader.Close()
+		}
+		if err := downloader.Download(r.URLs); err != nil {
+			if err == ErrNotModified {
+				return geoip.Info{}, err
+			}
+			return geoip.Info{}, fmt.Errorf("cannot download the database: %v", err)
+		}
+		dir = downloader.Base
+		release = downloader.Release
+	}
+
+	log.Printf("reloading database from %v", dir)
+	opts := r.Options
+	if downloader.Archive != "" {
+		opts.Source = redactURL(r.URLs[0])
+	}
+	opts.BuildDate = geoip.ReleaseBuildDate(release)
+	backend := r.Backend
+	if backend == "" {
+		backend = geoip.BACKEND_MAXMIND_CSV
+	}
+	db, err := geoip.OpenBackend(backend, dir, opts)
+	if err != nil {
+		return geoip.Info{}, err
+	}
+	if err := geoip.Validate(db); err != nil {
+		return geoip.Info{}, err
+	}
+	if db, err = r.overlay(db); err != nil {
+		return geoip.Info{}, err
+	}
+
+	old := r.DB.Swap(db)
+	if old != nil {
+		log.Printf("replaced database %v", old.Info())
+	}
+	if downloader.Archive != "" {
+		r.ETag = downloader.ETag
+		r.LastModified = downloader.LastModified
+	}
+	r.cacheDir = cacheDir
+	return db.Info(), nil
+}
+
+// overlay returns db with the overrides of OverrideFile, if any, and the
+// special-purpose addresses labeled.
+func (r *Reloader) overlay(db geoip.Database) (geoip.Database, error) {
+	overlay := &geoip.Overlay{Database: db}
+	if r.OverrideFile != "" {
+		overrides, err := geoip.LoadOverrides(r.OverrideFile)
+		if err != nil {
+			return nil, err
+		}
+		overlay.Overrides = overrides
+	}
+	return overlay, nil
+}
+
+// ReloadOverrides loads OverrideFile again, and swaps DB to the current
+// database with the new overrides.
+func (r *Reloader) ReloadOverrides() (geoip.Info, error) {
+	if !r.lock.TryLock() {
+		return geoip.Info{}, fmt.Errorf("reload already in progress")
+	}
+	defer r.lock.Unlock()
+
+	if r.OverrideFile == "" {
+		return geoip.Info{}, fmt.Errorf("no override file")
+	}
+	db := r.DB.Load()
+	if o, ok := db.(*geoip.Overlay); ok {
+		db = o.Database
+	}
+	db, err := r.overlay(db)
+	if err != nil {
+		return geoip.Info{}, err
+	}
+	r.DB.Store(db)
+	log.Printf("reloaded overrides from %v", r.OverrideFile)
+	return db.Info(), nil
+}
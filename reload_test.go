@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+const testCityCSV = `geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,subdivision_1_iso_code,subdivision_1_name,subdivision_2_iso_code,subdivision_2_name,city_name,metro_code,time_zone
+1850147,en,AS,Asia,JP,Japan,13,Tokyo,,,Tokyo,,Asia/Tokyo
+5097315,en,NA,"North America",US,"United States",NJ,"New Jersey",,,Fairfield,501,America/New_York
+`
+
+const testBlockHeader = "network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,postal_code,latitude,longitude,accuracy_radius\n"
+
+// Releases of the test database, locating 3.3.3.0/24 in Fairfield or in
+// Tokyo, and a release without blocks, which fails the validation.
+const (
+	testBlocksFairfield = testBlockHeader + "3.3.3.0/24,5097315,6252001,,0,0,07004,40.8838,-74.3060,1000\n"
+	testBlocksTokyo     = testBlockHeader + "3.3.3.0/24,1850147,1861060,,0,0,,35.6850,139.7514,500\n"
+	testBlocksEmpty     = testBlockHeader
+)
+
+// testRelease returns the files of a GeoLite2 City release with the given
+// block file.
+func testRelease(blocks string) map[string]string {
+	return map[string]string{
+		"GeoLite2-City-CSV_20180102/" + GEOLITE_BLOCK_CSV_FILE: blocks,
+		"GeoLite2-City-CSV_20180102/" + GEOLITE_CITY_CSV_FILE:  testCityCSV,
+	}
+}
+
+// writeTestRelease writes a release with the given block file into a
+// temporary directory, and returns the directory.
+func writeTestRelease(t *testing.T, blocks string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range testRelease(blocks) {
+		if err := os.WriteFile(filepath.Join(dir, filepath.Base(name)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func testLookupCity(t *testing.T, db *geoip.Handle, addr string) string {
+	t.Helper()
+	loc, err := db.Load().Lookup(netip.MustParseAddr(addr))
+	if err != nil {
+		t.Fatalf("%v: %v", addr, err)
+	}
+	return loc.City
+}
+
+func TestReloader_Swap(t *testing.T) {
+	db := geoip.NewHandle(newTestBlockDatabase(10, 2))
+	reloader := &Reloader{DB: db, Directory: writeTestRelease(t, testBlocksFairfield)}
+
+	old := db.Load()
+	info, err := reloader.Reload("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Blocks != 1 || testLookupCity(t, db, "3.3.3.3") != "Fairfield" {
+		t.Errorf("unexpected database: %v", info)
+	}
+	// a lookup holding the old database keeps using it
+	if loc, err := old.Lookup(netip.MustParseAddr("1.0.0.1")); err != nil || loc.City != "City0" {
+		t.Errorf("old database: %+v, %v", loc, err)
+	}
+	if _, err := db.Load().Lookup(netip.MustParseAddr("1.0.0.1")); err == nil {
+		t.Errorf("1.0.0.1 found in the new database")
+	}
+
+	if _, err := reloader.Reload(writeTestRelease(t, testBlocksTokyo)); err != nil {
+		t.Fatal(err)
+	}
+	if city := testLookupCity(t, db, "3.3.3.3"); city != "Tokyo" {
+		t.Errorf("unexpected city: %v", city)
+	}
+
+	// a failed reload keeps the current database
+	if _, err := reloader.Reload(writeTestRelease(t, testBlocksEmpty)); err == nil {
+		t.Errorf("no error for an invalid release")
+	}
+	if _, err := reloader.Reload(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("no error for a missing directory")
+	}
+	if city := testLookupCity(t, db, "3.3.3.3"); city != "Tokyo" {
+		t.Errorf("unexpected city: %v", city)
+	}
+}
+
+func TestReloader_InProgress(t *testing.T) {
+	db := geoip.NewHandle(newTestBlockDatabase(10, 2))
+	overrides := filepath.Join(t.TempDir(), "overrides.csv")
+	if err := os.WriteFile(overrides, []byte("3.3.3.0/24,ZZ,Nowhere,0,0,\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloader := &Reloader{DB: db, Directory: writeTestRelease(t, testBlocksFairfield), OverrideFile: overrides}
+
+	// a reload is running
+	reloader.lock.Lock()
+	for name, reload := range map[string]func() (geoip.Info, error){
+		"Reload":          func() (geoip.Info, error) { return reloader.Reload("") },
+		"Update":          reloader.Update,
+		"ReloadOverrides": reloader.ReloadOverrides,
+	} {
+		if _, err := reload(); err == nil {
+			t.Errorf("%v: no error during another reload", name)
+		}
+	}
+	if db.Load().Info().Blocks != 10 {
+		t.Errorf("database replaced during another reload")
+	}
+	reloader.lock.Unlock()
+
+	if _, err := reloader.Reload(""); err != nil {
+		t.Fatal(err)
+	}
+	if city := testLookupCity(t, db, "3.3.3.3"); city != "Nowhere" {
+		t.Errorf("overrides not applied: %v", city)
+	}
+}
+
+func TestReloader_Concurrent(t *testing.T) {
+	fairfield := writeTestRelease(t, testBlocksFairfield)
+	tokyo := writeTestRelease(t, testBlocksTokyo)
+	db := geoip.NewHandle(newTestBlockDatabase(10, 2))
+	server := NewServer(db)
+	server.Reloader = &Reloader{DB: db, Directory: fairfield}
+	server.ReloadDirs = true
+	if _, err := server.Reload(""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lookups during the reloads find the address in either database
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				loc, err := server.Lookup("3.3.3.3", time.Time{})
+				if err != nil || (loc.City != "Fairfield" && loc.City != "Tokyo") {
+					t.Errorf("lookup during reload: %+v, %v", loc, err)
+					return
+				}
+			}
+		}()
+	}
+
+	// concurrent reloads either succeed or are rejected
+	var reloads sync.WaitGroup
+	var lock sync.Mutex
+	succeeded := 0
+	for i := 0; i < 20; i++ {
+		reloads.Add(1)
+		go func(dir string) {
+			defer reloads.Done()
+			_, err := server.Reload(dir)
+			lock.Lock()
+			defer lock.Unlock()
+			if err == nil {
+				succeeded++
+			} else if err.Error() != "reload already in progress" {
+				t.Errorf("reload: %v", err)
+			}
+		}([]string{fairfield, tokyo}[i%2])
+	}
+	reloads.Wait()
+	close(quit)
+	wg.Wait()
+	if succeeded == 0 {
+		t.Errorf("no reload succeeded")
+	}
+}
+
+func TestReloader_CacheFallback(t *testing.T) {
+	server := newTestArchiveServer()
+	defer server.Close()
+	server.publish(`"v1"`, testBlocksFairfield)
+
+	db := geoip.NewHandle(newTestBlockDatabase(10, 2))
+	reloader := &Reloader{
+		DB:         db,
+		URLs:       []string{server.URL + "/GeoLite2-City-CSV.zip"},
+		Downloader: Downloader{WorkDir: t.TempDir()},
+		Cache:      &DatabaseCache{Dir: t.TempDir()},
+		Source:     "GeoLite2-City-CSV",
+	}
+	if _, err := reloader.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server fails: the cached version is kept without a reload
+	server.Close()
+	db.Swap(newTestBlockDatabase(10, 2))
+	if _, err := reloader.Update(); err != ErrNotModified {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if db.Load().Info().Blocks != 10 {
+		t.Errorf("database reloaded")
+	}
+	// but an explicit reload uses it
+	if _, err := reloader.Reload(""); err != nil || testLookupCity(t, db, "3.3.3.3") != "Fairfield" {
+		t.Errorf("cached version not reloaded: %v", err)
+	}
+}
+
+func TestHandleReload(t *testing.T) {
+	db := geoip.NewHandle(newTestBlockDatabase(10, 2))
+	server := NewServer(db)
+	server.Reloader = &Reloader{DB: db, Directory: writeTestRelease(t, testBlocksFairfield)}
+	ts := httptest.NewServer(server.httpHandler())
+	defer ts.Close()
+
+	tokyo := writeTestRelease(t, testBlocksTokyo)
+	post := func(query string) int {
+		resp, err := http.Post(ts.URL+"/reload"+query, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post("?dir=" + url.QueryEscape(tokyo)); status != http.StatusForbidden {
+		t.Errorf("reload from a given directory: status %v", status)
+	}
+	if _, err := server.Reload(tokyo); !errors.Is(err, ErrReloadDir) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if status := post(""); status != http.StatusOK || testLookupCity(t, db, "3.3.3.3") != "Fairfield" {
+		t.Errorf("reload: status %v", status)
+	}
+
+	server.ReloadDirs = true
+	if status := post("?dir=" + url.QueryEscape(tokyo)); status != http.StatusOK || testLookupCity(t, db, "3.3.3.3") != "Tokyo" {
+		t.Errorf("reload from a given directory: status %v", status)
+	}
+}
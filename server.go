@@ -2,16 +2,21 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"net"
+	"net/http"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/cinsk/goip/geoip"
 )
 
 const READ_TIMEOUT_SECONDS = 5
@@ -21,24 +26,68 @@ type Request interface {
 
 type LocationRequest struct {
 	Address string
-	Result  chan BlockEntry
+	Time    time.Time // zero means the time of arrival
+	Result  chan geoip.Location
 }
 
 type StatisticRequest struct {
 	Limit             int
 	Groups            int
 	MaxGroupIteration int
+	Window            time.Duration // zero means no window
+	Until             time.Time     // end of the window; zero means the latest entry
 	Stream            io.Writer
 	Formatter         Formatter
 	Done              chan struct{}
+
+	// If Result is not nil, the entries are sent to it instead of
+	// being written to Stream.
+	Result chan []PopulationEntry
 }
 
 type ResetRequest struct{}
 
+const (
+	KEY_CITY    = "city"
+	KEY_COUNTRY = "country"
+)
+
 type Server struct {
 	Groups int
 
-	population map[string]PopulationEntry
+	// DB is the database serving the lookups.
+	DB *geoip.Handle
+
+	// Verbose reports the addresses that are not found.
+	Verbose bool
+	// IncludeUnknown counts the addresses of unknown locations too.
+	IncludeUnknown bool
+	// IncludeSpecial counts the special-purpose addresses without a
+	// location (e.g. not in the overrides) under their category.
+	IncludeSpecial bool
+	// Key is the aggregation key, KEY_CITY or KEY_COUNTRY.
+	Key string
+
+	// StatDefaults holds the defaults of the statistic requests of the
+	// clients, formatted in csv with FieldOrder and FieldSeparator.
+	StatDefaults   StatisticRequest
+	FieldOrder     string
+	FieldSeparator string
+
+	population *ShardedPopulation
+	StatCache  *StatisticCache
+
+	// Reloader, if not nil, reloads the database on request.
+	Reloader *Reloader
+	// ReloadDirs lets the clients give the directory to reload from;
+	// otherwise the database is only reloaded from its configured source.
+	ReloadDirs bool
+	// Updater, if not nil, updates the database periodically.
+	Updater *Updater
+
+	// Series, if not nil, also counts the locations per time bucket.
+	Series     *TimeSeries
+	seriesLock sync.Mutex
 
 	serverGroup sync.WaitGroup
 
@@ -49,48 +98,86 @@ type Server struct {
 	listenerGroup sync.WaitGroup
 
 	workerGroup sync.WaitGroup
+
+	httpServers []*http.Server
 }
 
-func NewServer() *Server {
+// NewServer returns a server looking up the addresses in db.
+func NewServer(db *geoip.Handle) *Server {
 	return &Server{
-		population:  make(map[string]PopulationEntry),
-		Incoming:    make(chan Request),
-		quitChannel: make(chan struct{}),
+		DB:             db,
+		Key:            KEY_CITY,
+		IncludeSpecial: true,
+		StatDefaults:   StatisticRequest{Limit: 1000, Groups: 5, MaxGroupIteration: 20},
+		FieldOrder:     "name,pop,lat,lon,group",
+		FieldSeparator: "\t",
+		population:     NewShardedPopulation(),
+		StatCache:      NewStatisticCache(0),
+		Incoming:       make(chan Request),
+		quitChannel:    make(chan struct{}),
 	}
 }
 
-func (s *Server) serveLocation(r LocationRequest) {
-	entry, err := BlockDB.Search(r.Address)
+// Lookup searches the location of addr, and counts it in the statistics
+// at time t, or at the current time if t is zero.  The block database is
+// read-only, so Lookup may be called from multiple goroutines at once.
+func (s *Server) Lookup(addr string, t time.Time) (geoip.Location, error) {
+	loc, err := s.DB.Load().LookupString(addr)
 	if err != nil {
-		if verboseMode {
-			Err(0, err, "no entry for %s, ignored", r.Address)
+		if s.Verbose {
+			Err(0, err, "no entry for %s, ignored", addr)
 		}
-		if r.Result != nil {
-			r.Result <- BlockEntry{Error: err}
-		}
-		return
+		return loc, err
 	}
+
+	key, ok := s.populationKey(loc)
+	if !ok {
+		return loc, nil
+	}
+
+	if t.IsZero() {
+		t = time.Now()
+	}
+	s.population.Add(key, loc.Latitude, loc.Longitude, t)
+	if s.Series != nil {
+		s.seriesLock.Lock()
+		s.Series.Add(key, loc.Latitude, loc.Longitude, t)
+		s.seriesLock.Unlock()
+	}
+	return loc, nil
+}
+
+func (s *Server) serveLocation(r LocationRequest) {
+	loc, _ := s.Lookup(r.Address, r.Time)
 	if r.Result != nil {
-		r.Result <- entry
+		r.Result <- loc
 	}
+}
 
-	co, ci := entry.City.Country, entry.City.Name
-	if !includeUnknown && (co == "" || ci == "") {
-		return
+// populationKey returns the name the location is counted under,
+// according to the aggregation key.  It returns false if the location
+// should not be counted since it is unknown.
+func (s *Server) populationKey(loc geoip.Location) (string, bool) {
+	co, ci := loc.Country, loc.City
+	if co == "" && loc.Category != "" {
+		return loc.Category, s.IncludeSpecial
+	}
+	if s.Key == KEY_COUNTRY {
+		ci = ""
+	}
+	if !s.IncludeUnknown && (co == "" || (ci == "" && s.Key != KEY_COUNTRY)) {
+		return "", false
 	}
 	if co == "" {
 		co = "UNKNOWN"
 	}
+	if s.Key == KEY_COUNTRY {
+		return co, true
+	}
 	if ci == "" {
 		ci = "UNKNOWN"
 	}
-	key := fmt.Sprintf("%v: %v", co, ci)
-	if ent, ok := s.population[key]; ok {
-		ent.Count += 1
-		s.population[key] = ent
-	} else {
-		s.population[key] = PopulationEntry{Name: key, Count: 1, Latitude: entry.Latitude, Longitude: entry.Longitude}
-	}
+	return fmt.Sprintf("%v: %v", co, ci), true
 }
 
 type Centroid struct {
@@ -213,37 +300,54 @@ func NewCentroids(entries []PopulationEntry, ngroup int) *Centroids {
 	return &Centroids{Group: centroids}
 }
 
-func (s *Server) serveStatistic(r StatisticRequest) {
-	writer := NewPopulationWriter(r.Stream, r.Formatter)
-	defer writer.Flush()
+// Statistic returns the population entries sorted by population, limited
+// and grouped as asked by r.  The entries are computed from a consistent
+// snapshot of the population in the caller's goroutine, so the lookups
+// wait only while the snapshot is taken.  The entries may be shared with
+// other callers through the statistic cache, and must not be modified.
+func (s *Server) Statistic(r StatisticRequest) []PopulationEntry {
+	return s.StatCache.Get(r, func() []PopulationEntry {
+		entries := s.population.Entries(r.Window, r.Until)
+		sort.Sort(ByPopulation(entries))
+
+		if r.Limit < 0 {
+			r.Limit = len(entries)
+		}
+		if r.Limit > len(entries) {
+			r.Limit = len(entries)
+		}
 
-	writer.WriteHeader()
-	entries := make([]PopulationEntry, 0, len(s.population))
-	for _, v := range s.population {
-		entries = append(entries, v)
-	}
-	sort.Sort(ByPopulation(entries))
+		if r.Groups > 0 && r.Limit > 0 && len(entries) >= r.Groups {
+			Group(entries[:r.Limit], r.Groups, r.MaxGroupIteration)
+		}
+		return entries[:r.Limit]
+	})
+}
 
-	if r.Limit < 0 {
-		r.Limit = len(entries)
-	}
-	if r.Limit > len(entries) {
-		r.Limit = len(entries)
-	}
+func (s *Server) serveStatistic(r StatisticRequest) {
+	entries := s.Statistic(r)
 
-	if r.Groups > 0 && len(s.population) >= r.Groups {
-		Group(entries[:r.Limit], r.Groups, r.MaxGroupIteration)
+	if r.Result != nil {
+		r.Result <- entries
+	} else {
+		writer := NewPopulationWriter(r.Stream, r.Formatter)
+		writer.WriteHeader()
+		for _, e := range entries {
+			writer.WriteEntry(e)
+		}
+		writer.Flush()
 	}
 
-	for i := 0; i < r.Limit; i++ {
-		writer.WriteEntry(entries[i])
+	if r.Done != nil {
+		close(r.Done)
 	}
-
-	close(r.Done)
 }
 
 func (s *Server) Close() error {
 	close(s.quitChannel)
+	for _, hs := range s.httpServers {
+		hs.Shutdown(context.Background())
+	}
 	for _, ln := range s.Listeners {
 		ln.Close()
 	}
@@ -323,18 +427,20 @@ func (s *Server) createWorker(conn net.Conn) {
 
 			log.Printf("cmd[0]: [%T] %v", cmd[0], cmd[0])
 			if cmd[0] != '!' && cmd[0] != '.' {
-				resp := make(chan BlockEntry)
-				s.Incoming <- LocationRequest{Address: cmd, Result: resp}
-				result := <-resp
+				result, _ := s.Lookup(cmd, time.Time{})
 
-				if result.City.Country == "" {
-					result.City.Country = "UNKNOWN"
+				if result.Country == "" && result.Category != "" {
+					fmt.Fprintf(conn, "%v\n", result.Category)
+					continue
+				}
+				if result.Country == "" {
+					result.Country = "UNKNOWN"
 				}
-				if result.City.Name == "" {
-					result.City.Name = "UNKNOWN"
+				if result.City == "" {
+					result.City = "UNKNOWN"
 				}
 
-				msg := fmt.Sprintf("%v:%v\n", result.City.Country, result.City.Name)
+				msg := fmt.Sprintf("%v:%v\n", result.Country, result.City)
 				conn.Write([]byte(msg))
 			} else {
 				args := strings.Split(cmd[1:], " ")
@@ -351,6 +457,14 @@ func (s *Server) createWorker(conn net.Conn) {
 					s.doStat(conn, args[1:])
 				case "RESET":
 					s.Incoming <- ResetRequest{}
+				case "RELOAD":
+					s.doReload(conn, args[1:])
+				case "OVERRIDES":
+					s.doReloadOverrides(conn)
+				case "STATUS":
+					io.WriteString(conn, s.Status().String())
+				case "INFO":
+					s.doInfo(conn)
 				default:
 					log.Printf("unrecognized command %v received", args[0])
 				}
@@ -359,15 +473,18 @@ func (s *Server) createWorker(conn net.Conn) {
 	}()
 }
 
-func (s *Server) doStat(conn net.Conn, args []string) error {
-	var r StatisticRequest
-	r.Formatter, _ = NewFormatter("csv", fieldOrder, fieldSeparator)
-	r.Stream = conn
-	r.Done = make(chan struct{})
-	r.Limit = limitCount
-	r.Groups = numGroups
-	r.MaxGroupIteration = numGroupIteration
+// newStatisticRequest returns a StatisticRequest with the defaults for
+// the requests coming from the clients.
+func (s *Server) newStatisticRequest() StatisticRequest {
+	r := s.StatDefaults
+	r.Formatter, _ = NewFormatter("csv", s.FieldOrder, s.FieldSeparator)
+	r.Until = time.Now()
+	return r
+}
 
+// parseStatArgs updates r from the arguments of the stat command, each in
+// the form of NAME=VALUE.
+func (s *Server) parseStatArgs(r *StatisticRequest, args []string) error {
 	for _, arg := range args {
 		toks := strings.Split(arg, "=")
 
@@ -399,16 +516,107 @@ func (s *Server) doStat(conn net.Conn, args []string) error {
 			if int(ival) < r.MaxGroupIteration {
 				r.MaxGroupIteration = int(ival)
 			}
+		case "WINDOW":
+			window, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("cannot convert %v to duration", value)
+			}
+			r.Window = window
 		case "FORMAT":
-			formatter, err := NewFormatter(value, fieldOrder, fieldSeparator)
+			formatter, err := NewFormatter(value, s.FieldOrder, s.FieldSeparator)
 			if err != nil {
 				return err
 			}
 			r.Formatter = formatter
 		}
 	}
-	s.Incoming <- r
-	<-r.Done
+	return nil
+}
+
+// doReload reloads the database from the directory in args if any (see
+// ReloadDirs), and replies with the description of the new database.
+func (s *Server) doReload(conn net.Conn, args []string) {
+	var dir string
+	if len(args) > 0 {
+		dir = args[0]
+	}
+
+	info, err := s.Reload(dir)
+	if err != nil {
+		fmt.Fprintf(conn, "ERROR %v\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "OK %v\n", info)
+}
+
+// doInfo writes the description of the current database, and the memory
+// used by its tables.
+func (s *Server) doInfo(conn net.Conn) {
+	info := s.DB.Load().Info()
+	m := info.Memory
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%v\n", info)
+	for _, t := range []struct {
+		name  string
+		bytes int64
+	}{{"ranges", m.Ranges}, {"locations", m.Locations}, {"strings", m.Strings}, {"index", m.Index}, {"total", m.Total()}, {"mapped", m.Mapped}} {
+		fmt.Fprintf(w, "%-10s %10s\n", t.name, formatBytes(t.bytes))
+	}
+	w.Flush()
+}
+
+// doReloadOverrides reloads the override file only, and replies with the
+// description of the new database.
+func (s *Server) doReloadOverrides(conn net.Conn) {
+	info, err := s.ReloadOverrides()
+	if err != nil {
+		fmt.Fprintf(conn, "ERROR %v\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "OK %v\n", info)
+}
+
+// Status returns the state of the database updates, and the description
+// of the current database.
+func (s *Server) Status() UpdateStatus {
+	if s.Updater == nil {
+		return UpdateStatus{Database: s.DB.Load().Info()}
+	}
+	return s.Updater.Status()
+}
+
+// ErrReloadDir is returned by Reload for a directory given without
+// ReloadDirs.
+var ErrReloadDir = errors.New("reloading from a given directory is not enabled (see -reload-dir)")
+
+// Reload reloads the database through the Reloader of the server, from
+// dir if given and ReloadDirs is set.
+func (s *Server) Reload(dir string) (geoip.Info, error) {
+	if s.Reloader == nil {
+		return geoip.Info{}, fmt.Errorf("reload is not supported")
+	}
+	if dir != "" && !s.ReloadDirs {
+		return geoip.Info{}, ErrReloadDir
+	}
+	return s.Reloader.Reload(dir)
+}
+
+// ReloadOverrides reloads the override file only.
+func (s *Server) ReloadOverrides() (geoip.Info, error) {
+	if s.Reloader == nil {
+		return geoip.Info{}, fmt.Errorf("reload is not supported")
+	}
+	return s.Reloader.ReloadOverrides()
+}
+
+func (s *Server) doStat(conn net.Conn, args []string) error {
+	r := s.newStatisticRequest()
+	r.Stream = conn
+	if err := s.parseStatArgs(&r, args); err != nil {
+		return err
+	}
+
+	s.serveStatistic(r)
 	return nil
 }
 
@@ -426,9 +634,35 @@ func (s *Server) Start() {
 			case StatisticRequest:
 				log.Printf("STAT request received: %v", r)
 				s.serveStatistic(r)
+			case SeriesRequest:
+				log.Printf("SERIES request received: %v", r)
+				if s.Series != nil {
+					s.seriesLock.Lock()
+					if err := s.Series.Write(r.Stream, r.Format); err != nil {
+						Err(0, err, "cannot write the time series")
+					}
+					s.seriesLock.Unlock()
+				}
+				close(r.Done)
+			case MapRequest:
+				log.Printf("MAP request received: %v", r.Renderer.Output)
+				if s.Series != nil {
+					s.seriesLock.Lock()
+					if err := r.Renderer.Render(s.Series); err != nil {
+						Err(0, err, "cannot render the map")
+					}
+					s.seriesLock.Unlock()
+				}
+				close(r.Done)
 			case ResetRequest:
 				log.Printf("RESET request received")
-				s.population = map[string]PopulationEntry{}
+				s.population.Reset()
+				s.StatCache.Invalidate()
+				if s.Series != nil {
+					s.seriesLock.Lock()
+					s.Series.Reset()
+					s.seriesLock.Unlock()
+				}
 			}
 		}
 	}()
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+// newTestBlockDatabase returns a block database of n adjacent /24 blocks,
+// spread over ncity cities.
+func newTestBlockDatabase(n int, ncity int) *geoip.BlockDatabase {
+	var cities []geoip.CityEntry
+	for i := 0; i < ncity; i++ {
+		cities = append(cities, geoip.CityEntry{GeoID: i + 1, Country: "ZZ", Name: fmt.Sprintf("City%d", i)})
+	}
+
+	var entries []geoip.BlockEntry
+	for i := 0; i < n; i++ {
+		begin := uint32(0x01000000 + i*256)
+		city := cities[i%ncity]
+		entries = append(entries, geoip.BlockEntry{
+			IP4Range:  geoip.IP4Range{Begin: begin, End: begin + 255},
+			GeoID:     city.GeoID,
+			Latitude:  float32(i%180) - 90,
+			Longitude: float32(i%360) - 180,
+			City:      city,
+		})
+	}
+	return geoip.NewBlockDatabase(entries)
+}
+
+func testAddresses(db *geoip.BlockDatabase, n int) []string {
+	r := rand.New(rand.NewSource(1))
+	addrs := make([]string, n)
+	for i := range addrs {
+		e := db.Entry(r.Intn(db.Len()))
+		addrs[i] = geoip.Uint32ToIP(e.Begin + uint32(r.Intn(256))).String()
+	}
+	return addrs
+}
+
+func TestServer_ConcurrentLookup(t *testing.T) {
+	server := NewServer(geoip.NewHandle(newTestBlockDatabase(1000, 10)))
+	server.Start()
+	defer server.Close()
+
+	addrs := testAddresses(server.DB.Load().(*geoip.BlockDatabase), 1000)
+	const workers = 8
+	done := make(chan struct{})
+	for w := 0; w < workers; w++ {
+		go func() {
+			for _, addr := range addrs {
+				if _, err := server.Lookup(addr, time.Time{}); err != nil {
+					t.Errorf("lookup %v: %v", addr, err)
+				}
+			}
+			done <- struct{}{}
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		<-done
+	}
+
+	total := 0
+	for _, e := range server.population.Entries(0, time.Time{}) {
+		total += e.Count
+	}
+	if total != workers*len(addrs) {
+		t.Errorf("population total = %v, expected %v", total, workers*len(addrs))
+	}
+}
+
+func TestServer_SpecialPurpose(t *testing.T) {
+	server := NewServer(geoip.NewHandle(&geoip.Overlay{Database: newTestBlockDatabase(10, 2)}))
+	for _, addr := range []string{"1.0.0.1", "10.1.2.3", "192.168.0.1", "100.64.0.1", "fe80::1", "9.9.9.9"} {
+		server.Lookup(addr, time.Time{})
+	}
+	counts := map[string]int{}
+	for _, e := range server.population.Entries(0, time.Time{}) {
+		counts[e.Name] = e.Count
+	}
+	expected := map[string]int{"ZZ: City0": 1, "PRIVATE": 2, "CGNAT": 1, "LINK_LOCAL": 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected %v, got %v", expected, counts)
+	}
+
+	server = NewServer(geoip.NewHandle(&geoip.Overlay{Database: newTestBlockDatabase(10, 2)}))
+	server.IncludeSpecial = false
+	loc, err := server.Lookup("10.1.2.3", time.Time{})
+	if err != nil || loc.Category != geoip.CATEGORY_PRIVATE {
+		t.Errorf("unexpected location: %+v, %v", loc, err)
+	}
+	if n := len(server.population.Entries(0, time.Time{})); n != 0 {
+		t.Errorf("special-purpose address counted: %v", n)
+	}
+}
+
+// Run with -cpu 1,2,4,8 to see how the throughput scales with cores.
+func BenchmarkServer_Lookup(b *testing.B) {
+	server := NewServer(geoip.NewHandle(newTestBlockDatabase(100000, 1000)))
+	server.Start()
+	defer server.Close()
+	addrs := testAddresses(server.DB.Load().(*geoip.BlockDatabase), 4096)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.Intn(len(addrs))
+		for pb.Next() {
+			server.Lookup(addrs[i%len(addrs)], time.Time{})
+			i++
+		}
+	})
+}
+
+// The same lookups serialized through the server loop, for comparison.
+func BenchmarkServer_LookupSerialized(b *testing.B) {
+	server := NewServer(geoip.NewHandle(newTestBlockDatabase(100000, 1000)))
+	server.Start()
+	defer server.Close()
+	addrs := testAddresses(server.DB.Load().(*geoip.BlockDatabase), 4096)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		result := make(chan geoip.Location)
+		i := rand.Intn(len(addrs))
+		for pb.Next() {
+			server.Incoming <- LocationRequest{Address: addrs[i%len(addrs)], Result: result}
+			<-result
+			i++
+		}
+	})
+}
+
+func TestStatisticCache_TTL(t *testing.T) {
+	cache := NewStatisticCache(time.Hour)
+	calls := 0
+	compute := func() []PopulationEntry {
+		calls++
+		return []PopulationEntry{{Name: "ZZ: City0", Count: calls}}
+	}
+
+	r := StatisticRequest{Limit: 10}
+	cache.Get(r, compute)
+	if e := cache.Get(r, compute); calls != 1 || e[0].Count != 1 {
+		t.Errorf("cached statistic not used, calls = %v", calls)
+	}
+
+	r.Limit = 5
+	cache.Get(r, compute)
+	if calls != 2 {
+		t.Errorf("different parameters served from the cache, calls = %v", calls)
+	}
+
+	cache.Invalidate()
+	cache.Get(r, compute)
+	if calls != 3 {
+		t.Errorf("statistic cached after Invalidate, calls = %v", calls)
+	}
+
+	cache.TTL = 0
+	cache.Get(r, compute)
+	if calls != 4 {
+		t.Errorf("statistic cached with zero TTL, calls = %v", calls)
+	}
+}
+
+func TestStatisticCache_Until(t *testing.T) {
+	cache := NewStatisticCache(time.Hour)
+	calls := 0
+	compute := func() []PopulationEntry {
+		calls++
+		return nil
+	}
+
+	until := time.Date(2026, 10, 19, 12, 0, 10, 0, time.UTC)
+	tests := []struct {
+		window time.Duration
+		until  time.Time
+		calls  int
+	}{
+		{5 * time.Minute, until, 1},
+		{5 * time.Minute, until.Add(40 * time.Second), 1}, // same bucket
+		{5 * time.Minute, until.In(time.FixedZone("JST", 9*3600)), 1},
+		{5 * time.Minute, until.Add(time.Minute), 2},
+		{5 * time.Minute, until.Add(-time.Hour), 3},
+		{5 * time.Minute, time.Time{}, 4},
+		{0, until, 5},
+		{0, until.Add(time.Hour), 5}, // no window, Until is not used
+	}
+	for _, test := range tests {
+		cache.Get(StatisticRequest{Limit: 10, Window: test.window, Until: test.until}, compute)
+		if calls != test.calls {
+			t.Errorf("window %v until %v: calls = %v, expected %v", test.window, test.until, calls, test.calls)
+		}
+	}
+}
+
+func TestStatisticCache_Bounded(t *testing.T) {
+	compute := func() []PopulationEntry { return nil }
+	until := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	for _, ttl := range []time.Duration{0, time.Millisecond} {
+		cache := NewStatisticCache(ttl)
+		for i := 0; i < 100; i++ {
+			// a dashboard polling the last five minutes every minute
+			cache.Get(StatisticRequest{Limit: 10, Window: 5 * time.Minute, Until: until.Add(time.Duration(i) * time.Minute)}, compute)
+			if ttl > 0 {
+				time.Sleep(2 * ttl)
+			}
+		}
+		cache.lock.Lock()
+		n := len(cache.results)
+		cache.lock.Unlock()
+		if n > 1 {
+			t.Errorf("TTL %v: %v statistics cached", ttl, n)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type statisticKey struct {
+	Limit             int
+	Groups            int
+	MaxGroupIteration int
+	Window            time.Duration
+	Until             time.Time // truncated to the population bucket
+}
+
+type statisticResult struct {
+	done    chan struct{}
+	created time.Time
+	entries []PopulationEntry
+}
+
+// StatisticCache keeps the last statistic computed for each set of
+// parameters for TTL.  Concurrent callers asking for the same statistic
+// share one computation, even if TTL is zero.  The expired statistics are
+// dropped, so that the windowed statistics, keyed by the minute they end
+// at, do not pile up.
+type StatisticCache struct {
+	TTL time.Duration
+
+	lock    sync.Mutex
+	results map[statisticKey]*statisticResult
+}
+
+func NewStatisticCache(ttl time.Duration) *StatisticCache {
+	return &StatisticCache{TTL: ttl, results: make(map[statisticKey]*statisticResult)}
+}
+
+// Get returns the cached entries for r, or the entries returned by
+// compute.  The returned entries are shared, and must not be modified.
+func (c *StatisticCache) Get(r StatisticRequest, compute func() []PopulationEntry) []PopulationEntry {
+	key := statisticKey{r.Limit, r.Groups, r.MaxGroupIteration, r.Window, time.Time{}}
+	if r.Window > 0 {
+		// the window ends at the bucket of Until
+		key.Until = r.Until.Truncate(POPULATION_BUCKET_DURATION).UTC()
+	}
+
+	c.lock.Lock()
+	if res, ok := c.results[key]; ok {
+		select {
+		case <-res.done:
+			if time.Since(res.created) < c.TTL {
+				c.lock.Unlock()
+				return res.entries
+			}
+		default:
+			// being computed by another caller
+			c.lock.Unlock()
+			<-res.done
+			return res.entries
+		}
+	}
+	c.prune()
+	res := &statisticResult{done: make(chan struct{})}
+	c.results[key] = res
+	c.lock.Unlock()
+
+	res.entries = compute()
+	res.created = time.Now()
+	close(res.done)
+
+	if c.TTL <= 0 {
+		// only shared with the callers waiting for it
+		c.lock.Lock()
+		if c.results[key] == res {
+			delete(c.results, key)
+		}
+		c.lock.Unlock()
+	}
+	return res.entries
+}
+
+// prune drops the expired statistics; c.lock must be held.
+func (c *StatisticCache) prune() {
+	for key, res := range c.results {
+		select {
+		case <-res.done:
+			if time.Since(res.created) >= c.TTL {
+				delete(c.results, key)
+			}
+		default:
+		}
+	}
+}
+
+// Invalidate drops every cached statistic.
+func (c *StatisticCache) Invalidate() {
+	c.lock.Lock()
+	c.results = make(map[statisticKey]*statisticResult)
+	c.lock.Unlock()
+}
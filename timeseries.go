@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var seriesFormats = []string{"csv", "ndjson"}
+
+// TimeSeries counts the occurrences of each location per time bucket.
+type TimeSeries struct {
+	Bucket  time.Duration
+	Buckets map[int64]map[string]PopulationEntry
+}
+
+type SeriesRequest struct {
+	Format string
+	Stream io.Writer
+	Done   chan struct{}
+}
+
+func NewTimeSeries(bucket time.Duration) *TimeSeries {
+	return &TimeSeries{
+		Bucket:  bucket,
+		Buckets: make(map[int64]map[string]PopulationEntry),
+	}
+}
+
+func CheckSeriesFormat(format string) error {
+	for _, f := range seriesFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown series format: %v", format)
+}
+
+func (ts *TimeSeries) Reset() {
+	ts.Buckets = make(map[int64]map[string]PopulationEntry)
+}
+
+func (ts *TimeSeries) Add(key string, lat, lon float32, t time.Time) {
+	start := t.Truncate(ts.Bucket).Unix()
+
+	bucket, ok := ts.Buckets[start]
+	if !ok {
+		bucket = make(map[string]PopulationEntry)
+		ts.Buckets[start] = bucket
+	}
+	addPopulation(bucket, key, lat, lon, 1)
+}
+
+// Times returns the start of every bucket, in chronological order.
+func (ts *TimeSeries) Times() []int64 {
+	times := make([]int64, 0, len(ts.Buckets))
+	for k := range ts.Buckets {
+		times = append(times, k)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times
+}
+
+// BucketEntries returns the entries of the bucket starting at start,
+// sorted by population in descending order, then by name.
+func (ts *TimeSeries) BucketEntries(start int64) []PopulationEntry {
+	bucket := ts.Buckets[start]
+	entries := make([]PopulationEntry, 0, len(bucket))
+	for _, v := range bucket {
+		entries = append(entries, v)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// seriesRecord is a line of the time series; the special-purpose
+// addresses have no coordinates.
+type seriesRecord struct {
+	Time      string   `json:"time"`
+	Name      string   `json:"name"`
+	Count     int      `json:"pop"`
+	Latitude  *float32 `json:"lat,omitempty"`
+	Longitude *float32 `json:"lon,omitempty"`
+}
+
+func newSeriesRecord(stamp string, e PopulationEntry) seriesRecord {
+	r := seriesRecord{Time: stamp, Name: e.Name, Count: e.Count}
+	if !e.IsCategory() {
+		r.Latitude, r.Longitude = &e.Latitude, &e.Longitude
+	}
+	return r
+}
+
+// Write prints the time series in long format, one line per bucket and
+// location, either in CSV or in newline-delimited JSON.
+func (ts *TimeSeries) Write(out io.Writer, format string) error {
+	if err := CheckSeriesFormat(format); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	writer := csv.NewWriter(w)
+	encoder := json.NewEncoder(w)
+
+	if format == "csv" {
+		writer.Write([]string{"time", "name", "pop", "lat", "lon"})
+	}
+	for _, start := range ts.Times() {
+		stamp := time.Unix(start, 0).UTC().Format(time.RFC3339)
+
+		for _, e := range ts.BucketEntries(start) {
+			r := newSeriesRecord(stamp, e)
+			var err error
+			if format == "csv" {
+				lat, lon := "", ""
+				if r.Latitude != nil {
+					lat, lon = fmt.Sprint(*r.Latitude), fmt.Sprint(*r.Longitude)
+				}
+				err = writer.Write([]string{stamp, e.Name, strconv.Itoa(e.Count), lat, lon})
+			} else {
+				err = encoder.Encode(r)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
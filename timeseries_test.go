@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+func TestTimeSeries_Buckets(t *testing.T) {
+	base := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	ts := NewTimeSeries(5 * time.Minute)
+	ts.Add("A", 0, 0, base)
+	ts.Add("B", 0, 0, base.Add(4*time.Minute+59*time.Second))
+	ts.Add("B", 0, 0, base.Add(time.Minute))
+	ts.Add("A", 0, 0, base.Add(5*time.Minute))
+	ts.Add("C", 0, 0, base.Add(-time.Second))
+	ts.Add("A", 0, 0, base.Add(time.Hour))
+
+	expected := []int64{
+		base.Add(-5 * time.Minute).Unix(),
+		base.Unix(),
+		base.Add(5 * time.Minute).Unix(),
+		base.Add(time.Hour).Unix(),
+	}
+	if times := ts.Times(); !reflect.DeepEqual(times, expected) {
+		t.Fatalf("expected buckets %v, got %v", expected, times)
+	}
+
+	var names []string
+	for _, e := range ts.BucketEntries(base.Unix()) {
+		names = append(names, e.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"B", "A"}) {
+		t.Errorf("unexpected bucket entries: %v", names)
+	}
+	if e := ts.BucketEntries(base.Add(time.Minute).Unix()); len(e) != 0 {
+		t.Errorf("unexpected bucket: %v", e)
+	}
+
+	ts.Reset()
+	if times := ts.Times(); len(times) != 0 {
+		t.Errorf("buckets after reset: %v", times)
+	}
+}
+
+// testSeries counts a few addresses of the test database, one every 20
+// seconds, in buckets of a minute.
+func testSeries(t *testing.T, key string) *TimeSeries {
+	t.Helper()
+	server := NewServer(geoip.NewHandle(&geoip.Overlay{Database: newTestBlockDatabase(10, 2)}))
+	server.Key = key
+	server.Series = NewTimeSeries(time.Minute)
+
+	base := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	for i, addr := range []string{"1.0.0.1", "1.0.1.1", "1.0.2.1", "10.0.0.1", "9.9.9.9"} {
+		if _, err := server.Lookup(addr, base.Add(time.Duration(i)*20*time.Second)); err != nil && addr != "9.9.9.9" {
+			t.Fatalf("%v: %v", addr, err)
+		}
+	}
+	return server.Series
+}
+
+func TestTimeSeries_Key(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{KEY_CITY, `time,name,pop,lat,lon
+2026-10-19T12:00:00Z,ZZ: City0,2,-90,-180
+2026-10-19T12:00:00Z,ZZ: City1,1,-89,-179
+2026-10-19T12:01:00Z,PRIVATE,1,,
+`},
+		// the coordinates of the first city seen
+		{KEY_COUNTRY, `time,name,pop,lat,lon
+2026-10-19T12:00:00Z,ZZ,3,-90,-180
+2026-10-19T12:01:00Z,PRIVATE,1,,
+`},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := testSeries(t, test.key).Write(&out, "csv"); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.expected {
+			t.Errorf("key %v: expected\n%v\ngot\n%v", test.key, test.expected, out.String())
+		}
+	}
+}
+
+func TestTimeSeries_CSVQuoting(t *testing.T) {
+	ts := NewTimeSeries(time.Minute)
+	names := []string{`US: Washington, D.C.`, `ZZ: "Quoted"`, "ZZ: Plain"}
+	for _, name := range names {
+		ts.Add(name, 1.5, -2.25, time.Unix(0, 0))
+	}
+
+	var out bytes.Buffer
+	if err := ts.Write(&out, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1+len(names) {
+		t.Fatalf("unexpected records: %q", records)
+	}
+	for i, r := range records[1:] {
+		expected := []string{"1970-01-01T00:00:00Z", names[i], "1", "1.5", "-2.25"}
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("expected %q, got %q", expected, r)
+		}
+	}
+}
+
+func TestTimeSeries_NDJSON(t *testing.T) {
+	var out bytes.Buffer
+	if err := testSeries(t, KEY_CITY).Write(&out, "ndjson"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := []string{
+		`{"time":"2026-10-19T12:00:00Z","name":"ZZ: City0","pop":2,"lat":-90,"lon":-180}`,
+		`{"time":"2026-10-19T12:00:00Z","name":"ZZ: City1","pop":1,"lat":-89,"lon":-179}`,
+		`{"time":"2026-10-19T12:01:00Z","name":"PRIVATE","pop":1}`,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected\n%v\ngot\n%v", strings.Join(expected, "\n"), out.String())
+	}
+	for _, line := range lines {
+		var r seriesRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Errorf("%v: %v", line, err)
+		}
+	}
+
+	if err := NewTimeSeries(time.Minute).Write(&out, "xml"); err == nil {
+		t.Errorf("no error for an unknown format")
+	}
+}
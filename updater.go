@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+// UpdateStatus describes the state of the automatic database updates.
+type UpdateStatus struct {
+	Interval   time.Duration `json:"interval"`
+	LastCheck  time.Time     `json:"last_check"`
+	LastUpdate time.Time     `json:"last_update"`
+	NextCheck  time.Time     `json:"next_check"`
+	LastError  string        `json:"last_error,omitempty"`
+	Database   geoip.Info    `json:"database"`
+}
+
+// MarshalJSON writes the interval as a duration string, e.g. "24h0m0s",
+// as in String.
+func (s UpdateStatus) MarshalJSON() ([]byte, error) {
+	type status UpdateStatus
+	return json.Marshal(struct {
+		Interval string `json:"interval"`
+		status
+	}{s.Interval.String(), status(s)})
+}
+
+func (s UpdateStatus) String() string {
+	var b strings.Builder
+	stamp := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Format(time.RFC3339)
+	}
+	fmt.Fprintf(&b, "database: %v\n", s.Database)
+	fmt.Fprintf(&b, "interval: %v\n", s.Interval)
+	fmt.Fprintf(&b, "last_check: %v\n", stamp(s.LastCheck))
+	fmt.Fprintf(&b, "last_update: %v\n", stamp(s.LastUpdate))
+	fmt.Fprintf(&b, "next_check: %v\n", stamp(s.NextCheck))
+	if s.LastError != "" {
+		fmt.Fprintf(&b, "last_error: %v\n", s.LastError)
+	}
+	return b.String()
+}
+
+// Updater checks for a new database archive periodically, and reloads the
+// database when the archive changed.  When an update fails, the current
+// database keeps serving, and the error is kept in the status.
+type Updater struct {
+	Interval time.Duration
+	Reloader *Reloader
+
+	lock   sync.Mutex
+	status UpdateStatus
+}
+
+func NewUpdater(reloader *Reloader, interval time.Duration) *Updater {
+	return &Updater{Interval: interval, Reloader: reloader}
+}
+
+// Check checks the archive once, and reloads the database if changed.
+func (u *Updater) Check() error {
+	log.Printf("checking for database update: %v", redactURL(u.Reloader.URLs[0]))
+	info, err := u.Reloader.Update()
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.status.LastCheck = time.Now()
+	switch err {
+	case nil:
+		u.status.LastUpdate = u.status.LastCheck
+		u.status.LastError = ""
+		fmt.Fprintf(os.Stderr, "database updated: %v\n", info)
+	case ErrNotModified:
+		u.status.LastError = ""
+		log.Printf("database archive not modified")
+		err = nil
+	default:
+		u.status.LastError = err.Error()
+		Err(0, err, "database update failed")
+	}
+	return err
+}
+
+// Run checks for updates every Interval until quit is closed.
+func (u *Updater) Run(quit <-chan struct{}) {
+	ticker := time.NewTicker(u.Interval)
+	defer ticker.Stop()
+
+	for {
+		u.lock.Lock()
+		u.status.NextCheck = time.Now().Add(u.Interval)
+		u.lock.Unlock()
+
+		select {
+		case <-ticker.C:
+			u.Check()
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (u *Updater) Status() UpdateStatus {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	status := u.status
+	status.Interval = u.Interval
+	status.Database = u.Reloader.DB.Load().Info()
+	return status
+}
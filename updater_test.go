@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+// testArchiveServer serves a release archive with its ETag, and answers
+// 304 to a request with the same ETag.
+type testArchiveServer struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	etag      string
+	archive   []byte
+	downloads int
+}
+
+func newTestArchiveServer() *testArchiveServer {
+	s := &testArchiveServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if r.Header.Get("If-None-Match") == s.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		s.downloads++
+		w.Header().Set("ETag", s.etag)
+		w.Write(s.archive)
+	}))
+	return s
+}
+
+func (s *testArchiveServer) publish(etag string, blocks string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.etag = etag
+	s.archive = zipArchive(testRelease(blocks))
+}
+
+func (s *testArchiveServer) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.downloads
+}
+
+func TestUpdater_Check(t *testing.T) {
+	server := newTestArchiveServer()
+	defer server.Close()
+	server.publish(`"v1"`, testBlocksFairfield)
+
+	db := geoip.NewHandle(newTestBlockDatabase(10, 2))
+	reloader := &Reloader{
+		DB:         db,
+		URLs:       []string{server.URL + "/GeoLite2-City-CSV.zip"},
+		Downloader: Downloader{WorkDir: t.TempDir()},
+	}
+	updater := NewUpdater(reloader, time.Hour)
+
+	if err := updater.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if city := testLookupCity(t, db, "3.3.3.3"); city != "Fairfield" || server.count() != 1 {
+		t.Fatalf("city %q after %v downloads", city, server.count())
+	}
+	updated := updater.Status().LastUpdate
+
+	// not modified: no download, and no update
+	if err := updater.Check(); err != nil {
+		t.Fatal(err)
+	}
+	status := updater.Status()
+	if server.count() != 1 || status.LastUpdate != updated || status.LastError != "" {
+		t.Errorf("%v downloads, status %+v", server.count(), status)
+	}
+	if !status.LastCheck.After(updated) {
+		t.Errorf("last check %v not after %v", status.LastCheck, updated)
+	}
+
+	// a release failing the validation keeps the current database
+	server.publish(`"v2"`, testBlocksEmpty)
+	if err := updater.Check(); err == nil {
+		t.Errorf("no error for an invalid release")
+	}
+	status = updater.Status()
+	if server.count() != 2 || status.LastUpdate != updated || status.LastError == "" {
+		t.Errorf("%v downloads, status %+v", server.count(), status)
+	}
+	if city := testLookupCity(t, db, "3.3.3.3"); city != "Fairfield" {
+		t.Errorf("database replaced by an invalid release: %v", city)
+	}
+
+	server.publish(`"v3"`, testBlocksTokyo)
+	if err := updater.Check(); err != nil {
+		t.Fatal(err)
+	}
+	status = updater.Status()
+	if city := testLookupCity(t, db, "3.3.3.3"); city != "Tokyo" || status.LastError != "" || !status.LastUpdate.After(updated) {
+		t.Errorf("city %q, status %+v", city, status)
+	}
+	if reloader.ETag != `"v3"` {
+		t.Errorf("unexpected ETag: %v", reloader.ETag)
+	}
+}
+
+func TestHandleStatus(t *testing.T) {
+	db := geoip.NewHandle(newTestBlockDatabase(10, 2))
+	server := NewServer(db)
+	server.Updater = NewUpdater(&Reloader{DB: db}, 24*time.Hour)
+	ts := httptest.NewServer(server.httpHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status["interval"] != "24h0m0s" {
+		t.Errorf("unexpected interval: %#v", status["interval"])
+	}
+	if _, ok := status["database"].(map[string]any); !ok {
+		t.Errorf("no database in %v", status)
+	}
+	if _, ok := status["last_check"]; !ok {
+		t.Errorf("no last_check in %v", status)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/cinsk/goip/geoip"
+)
+
+var validateFormats = []string{"text", "json"}
+
+// CheckValidateFormat returns an error if format is not one of
+// validateFormats.
+func CheckValidateFormat(format string) error {
+	for _, f := range validateFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown validation report format %q (one of %v)", format, validateFormats)
+}
+
+// WriteValidationReport writes the report to out.  In text, a line is
+// written per problem, as FILE:LINE: SEVERITY: KIND: MESSAGE, followed by
+// the summary as comment lines; in json, the report as a single document.
+func WriteValidationReport(out io.Writer, format string, r *geoip.ValidationReport) error {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	}
+
+	for _, p := range r.Problems {
+		fmt.Fprintln(w, p)
+	}
+	fmt.Fprintf(w, "# %v: %v city lines, %v block lines\n", r.Directory, r.Cities, r.Blocks)
+	fmt.Fprintf(w, "# %-24s %10d\n", "errors", r.Errors)
+	fmt.Fprintf(w, "# %-24s %10d\n", "warnings", r.Warnings)
+	kinds := make([]string, 0, len(r.Counts))
+	for kind := range r.Counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		n := r.Counts[kind]
+		if n > geoip.MAX_PROBLEMS {
+			fmt.Fprintf(w, "# %-24s %10d (%v listed)\n", kind, n, geoip.MAX_PROBLEMS)
+		} else {
+			fmt.Fprintf(w, "# %-24s %10d\n", kind, n)
+		}
+	}
+	return nil
+}